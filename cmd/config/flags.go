@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -36,43 +40,305 @@ func (f *FlagRunAddr) Set(s string) error {
 	return nil
 }
 
+// -------------------------------CONSTANTS--------------------------------
+const (
+	DefaultShortURLLength = 10 // length of the generated {id}
+	MaxShortURLLength     = 64
+)
+
 // -------------------------------VARIABLES--------------------------------
-var HostFlags FlagRunAddr
-var UrlID string // {id} for shortening url in POST request
+var HostFlags = FlagRunAddr{Host: "localhost", Port: 8080}
+var BaseURL = "http://localhost:8080/"          // public prefix of the short URLs, always ends with "/"
+var ShortURLLength = DefaultShortURLLength      // length of the generated {id}
+var FileStoragePath string                      // JSON lines file with the links, empty to keep them in memory only
+var DatabaseDSN string                          // database connection string, has priority over FileStoragePath
+var JanitorInterval = time.Minute               // how often the expired links are purged
+var ExpiredRetention = 30 * 24 * time.Hour      // how long an expired link answers 410 and keeps its id before the purge
+var AuthSecret string                           // key to sign the user cookies, random on every start if empty
+var PasswordMaxAttempts = 5                     // wrong passwords in a row before a client is locked out of a link
+var PasswordLinkMaxAttempts = 100               // wrong passwords of a link from all clients before everybody is locked out
+var PasswordLockout = 15 * time.Minute          // how long the lockout lasts
+var RedirectType = http.StatusTemporaryRedirect // status of the redirect for the links without their own
+var PermanentRedirectMaxAge = 24 * time.Hour    // how long the clients may cache a permanent redirect
+var GeoIPDatabase string                        // MaxMind DB file for the geo rules, empty to turn them off
+var TrustedProxies []*net.IPNet                 // whose X-Forwarded-For tells the client address
+var HealthCheckInterval = 30 * time.Second      // how often the destinations of the links with a fallback are probed
+var HealthCheckTimeout = 5 * time.Second        // how long a destination has to answer a probe
+var HealthCheckPrivate bool                     // probe the destinations in private networks too (an intranet shortener)
+
+// IDRegexp is the allowed {id} of a short URL
+var IDRegexp = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+// DefaultReservedIDs can't be used as {id}: they are routes or may become ones
+const DefaultReservedIDs = "api,ping,admin,static,health,metrics,login,logout"
+
+// ReservedIDs is the set of reserved {id}s in lower case
+var ReservedIDs = parseReservedIDs(DefaultReservedIDs)
+
+// IsReservedID tells if the {id} is reserved (case insensitive)
+func IsReservedID(id string) bool {
+	return ReservedIDs[strings.ToLower(id)]
+}
+
+// parseReservedIDs makes the set out of the comma separated list
+func parseReservedIDs(s string) map[string]bool {
+	ids := map[string]bool{}
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.ToLower(strings.TrimSpace(id)); id != "" {
+			ids[id] = true
+		}
+	}
+	return ids
+}
 
 // ----------------------------FUNCTIONS------------------------------------
-func ParseFlags() {
-	var envErrHostFlags error
-	var godotenvError error
 
-	// Parse from the env variables first
-	godotenvError = godotenv.Load(`variables.env`)
-	if godotenvError != nil {
-		log.Fatalf("godotenv error: %s", godotenvError)
+// IsRedirectType tells if the status can be used for the redirect of a link
+func IsRedirectType(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
 	}
-	envErrHostFlags = HostFlags.Set(os.Getenv("SERVER_ADDRESS_HOST") + ":" + os.Getenv("SERVER_ADDRESS_PORT"))
-	if envErrHostFlags != nil {
-		log.Fatal("os.Getenv error")
+	return false
+}
+
+func setRedirectType(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil || !IsRedirectType(n) {
+		return fmt.Errorf("Invalid redirect type: %q (must be 301, 302, 307 or 308)", s)
 	}
-	UrlID = os.Getenv("BASE_URL")
+	RedirectType = n
+	return nil
+}
 
-	// If no success with env variables then parse from flags
-	flag.Var(&HostFlags, "a", "address and port to run server")
-	flag.Func("b", "shortened URL path", func(s string) error {
-		if !regexp.MustCompile(`[a-zA-Z0-9-]+$`).MatchString(s) {
-			return fmt.Errorf("Invalid URL ID: %s", s)
+// setTrustedProxies parses the comma separated networks like 10.0.0.0/8,192.0.2.1,
+// a single address is a network of its own
+func setTrustedProxies(s string) error {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return fmt.Errorf("Invalid trusted proxy: %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return fmt.Errorf("Invalid trusted proxy: %q", item)
 		}
-		UrlID = s
+		networks = append(networks, network)
+	}
+	TrustedProxies = networks
+	return nil
+}
+
+// setBaseURL validates the public base URL like https://s.example.com/ or http://localhost:8080/links/
+func setBaseURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("Invalid base URL %q: %w", s, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid base URL %q: must be absolute http(s) URL", s)
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("Invalid base URL %q: no query, fragment or user info allowed", s)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	BaseURL = u.String()
+	return nil
+}
+
+func setShortURLLength(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	if n <= 0 || n > MaxShortURLLength {
+		return fmt.Errorf("Invalid short URL length: %d (must be 1..%d)", n, MaxShortURLLength)
+	}
+	ShortURLLength = n
+	return nil
+}
+
+func ParseFlags() {
+	// Load variables.env into the environment if it is there
+	if godotenvError := godotenv.Load(`variables.env`); godotenvError != nil {
+		log.Printf("godotenv error: %s", godotenvError)
+	}
+
+	// Parse the flags first, the env variables below have priority over them
+	baseURLSet := false
+	flag.Var(&HostFlags, "a", "address and port to run server")
+	flag.Func("b", "public base URL of the short links, e.g. https://s.example.com/", func(s string) error {
+		baseURLSet = true
+		return setBaseURL(s)
+	})
+	flag.Func("l", "length of the generated short URL id", setShortURLLength)
+	flag.StringVar(&FileStoragePath, "f", FileStoragePath, "file to store the links in (empty for memory only)")
+	flag.StringVar(&DatabaseDSN, "d", DatabaseDSN, "database DSN (postgres:// URL or SQLite file)")
+	flag.StringVar(&AuthSecret, "s", AuthSecret, "secret key to sign the user cookies")
+	flag.DurationVar(&JanitorInterval, "j", JanitorInterval, "how often the expired links are purged")
+	flag.DurationVar(&ExpiredRetention, "k", ExpiredRetention, "how long an expired link is kept before the purge")
+	flag.IntVar(&PasswordMaxAttempts, "p", PasswordMaxAttempts, "wrong link passwords in a row before a lockout")
+	flag.IntVar(&PasswordLinkMaxAttempts, "P", PasswordLinkMaxAttempts, "wrong link passwords from all clients before the link is locked")
+	flag.DurationVar(&PasswordLockout, "L", PasswordLockout, "how long a client is locked out of a link after wrong passwords")
+	flag.Func("t", "default redirect status: 301, 302, 307 or 308 (default 307)", setRedirectType)
+	flag.DurationVar(&PermanentRedirectMaxAge, "c", PermanentRedirectMaxAge, "how long the clients may cache a permanent redirect")
+	flag.StringVar(&GeoIPDatabase, "g", GeoIPDatabase, "MaxMind DB file (e.g. GeoLite2-Country.mmdb) for the geo rules of the links")
+	flag.Func("x", "comma separated networks of the trusted proxies, their X-Forwarded-For is believed", setTrustedProxies)
+	flag.DurationVar(&HealthCheckInterval, "i", HealthCheckInterval, "how often the destinations of the links with a fallback URL are probed")
+	flag.DurationVar(&HealthCheckTimeout, "T", HealthCheckTimeout, "how long a destination has to answer a health probe")
+	flag.BoolVar(&HealthCheckPrivate, "H", HealthCheckPrivate, "allow the links with a fallback URL to private, loopback and link-local destinations")
+	flag.Func("r", "comma separated ids that can't be aliases (default "+DefaultReservedIDs+")", func(s string) error {
+		ReservedIDs = parseReservedIDs(s)
 		return nil
 	})
+	flag.Parse()
+
+	// Env variables
+	if host, port := os.Getenv("SERVER_ADDRESS_HOST"), os.Getenv("SERVER_ADDRESS_PORT"); host != "" || port != "" {
+		if err := HostFlags.Set(host + ":" + port); err != nil {
+			log.Fatalf("SERVER_ADDRESS env error: %s", err)
+		}
+	}
+	if s := os.Getenv("BASE_URL"); s != "" {
+		if err := setBaseURL(s); err != nil {
+			log.Fatalf("BASE_URL env error: %s", err)
+		}
+		baseURLSet = true
+	}
+	if s := os.Getenv("SHORT_URL_LENGTH"); s != "" {
+		if err := setShortURLLength(s); err != nil {
+			log.Fatalf("SHORT_URL_LENGTH env error: %s", err)
+		}
+	}
+
+	if s, ok := os.LookupEnv("FILE_STORAGE_PATH"); ok {
+		FileStoragePath = s
+	}
+	if s, ok := os.LookupEnv("DATABASE_DSN"); ok {
+		DatabaseDSN = s
+	}
+	if s, ok := os.LookupEnv("AUTH_SECRET"); ok {
+		AuthSecret = s
+	}
+	if s := os.Getenv("JANITOR_INTERVAL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			log.Fatalf("JANITOR_INTERVAL env error: %q is not a positive duration", s)
+		}
+		JanitorInterval = d
+	}
+	if s := os.Getenv("EXPIRED_RETENTION"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			log.Fatalf("EXPIRED_RETENTION env error: %q is not a duration", s)
+		}
+		ExpiredRetention = d
+	}
+	if s := os.Getenv("PASSWORD_MAX_ATTEMPTS"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			log.Fatalf("PASSWORD_MAX_ATTEMPTS env error: %q is not a positive number", s)
+		}
+		PasswordMaxAttempts = n
+	}
+	if s := os.Getenv("PASSWORD_LINK_MAX_ATTEMPTS"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			log.Fatalf("PASSWORD_LINK_MAX_ATTEMPTS env error: %q is not a positive number", s)
+		}
+		PasswordLinkMaxAttempts = n
+	}
+	if s := os.Getenv("PASSWORD_LOCKOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			log.Fatalf("PASSWORD_LOCKOUT env error: %q is not a positive duration", s)
+		}
+		PasswordLockout = d
+	}
+	if s := os.Getenv("REDIRECT_TYPE"); s != "" {
+		if err := setRedirectType(s); err != nil {
+			log.Fatalf("REDIRECT_TYPE env error: %s", err)
+		}
+	}
+	if s := os.Getenv("PERMANENT_REDIRECT_MAX_AGE"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			log.Fatalf("PERMANENT_REDIRECT_MAX_AGE env error: %q is not a duration", s)
+		}
+		PermanentRedirectMaxAge = d
+	}
+	if s, ok := os.LookupEnv("GEOIP_DATABASE"); ok {
+		GeoIPDatabase = s
+	}
+	if s, ok := os.LookupEnv("TRUSTED_PROXIES"); ok {
+		if err := setTrustedProxies(s); err != nil {
+			log.Fatalf("TRUSTED_PROXIES env error: %s", err)
+		}
+	}
+	if s := os.Getenv("HEALTH_CHECK_INTERVAL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			log.Fatalf("HEALTH_CHECK_INTERVAL env error: %q is not a positive duration", s)
+		}
+		HealthCheckInterval = d
+	}
+	if s := os.Getenv("HEALTH_CHECK_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			log.Fatalf("HEALTH_CHECK_TIMEOUT env error: %q is not a positive duration", s)
+		}
+		HealthCheckTimeout = d
+	}
+	if s := os.Getenv("HEALTH_CHECK_PRIVATE"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			log.Fatalf("HEALTH_CHECK_PRIVATE env error: %q is not a boolean", s)
+		}
+		HealthCheckPrivate = b
+	}
+	if s, ok := os.LookupEnv("RESERVED_IDS"); ok {
+		ReservedIDs = parseReservedIDs(s)
+	}
 
-	if envErrHostFlags != nil || (HostFlags.Host == "" && HostFlags.Port == 0) {
-		log.Println("Error parsing host flags: ", envErrHostFlags)
+	if HostFlags.Host == "" && HostFlags.Port == 0 {
+		log.Println("Error parsing host flags: ", HostFlags)
+	}
+	if JanitorInterval <= 0 {
+		log.Fatalf("janitor interval must be positive, got %s", JanitorInterval)
 	}
-	if UrlID == "" {
-		log.Println("Error parsing url ID: ", UrlID)
+	if ExpiredRetention < 0 {
+		log.Fatalf("expired retention can't be negative, got %s", ExpiredRetention)
 	}
-	if envErrHostFlags != nil || UrlID == "" {
-		flag.Parse()
+	if HealthCheckInterval <= 0 || HealthCheckTimeout <= 0 {
+		log.Fatalf("health check interval and timeout must be positive, got %s and %s", HealthCheckInterval, HealthCheckTimeout)
+	}
+	if PasswordMaxAttempts <= 0 || PasswordLinkMaxAttempts <= 0 || PasswordLockout <= 0 {
+		log.Fatalf("password lockout must be positive, got %d attempts for %s", PasswordMaxAttempts, PasswordLockout)
+	}
+	if AuthSecret == "" {
+		log.Println("AUTH_SECRET is not set, user cookies will be invalid after restart")
+	}
+	if !baseURLSet { // the links lead to the server itself
+		host := HostFlags.Host
+		if host == "" {
+			host = "localhost"
+		}
+		if err := setBaseURL("http://" + net.JoinHostPort(host, strconv.Itoa(HostFlags.Port)) + "/"); err != nil {
+			log.Fatalf("base URL error: %s", err)
+		}
 	}
 }
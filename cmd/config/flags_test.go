@@ -0,0 +1,113 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_setBaseURL(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Value   string
+		Want    string
+		WantErr bool
+	}{
+		{Name: "Host only", Value: "https://s.example.com", Want: "https://s.example.com/"},
+		{Name: "With path", Value: "http://localhost:8080/links", Want: "http://localhost:8080/links/"},
+		{Name: "Trailing slash", Value: "https://s.example.com/", Want: "https://s.example.com/"},
+		{Name: "Old style id", Value: "hash", WantErr: true},
+		{Name: "No scheme", Value: "s.example.com/", WantErr: true},
+		{Name: "Not http", Value: "ftp://s.example.com/", WantErr: true},
+		{Name: "Query", Value: "https://s.example.com/?a=b", WantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			old := BaseURL
+			defer func() { BaseURL = old }()
+
+			err := setBaseURL(tc.Value)
+			if tc.WantErr {
+				require.Error(t, err)
+				require.Equal(t, old, BaseURL)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.Want, BaseURL)
+		})
+	}
+}
+
+func Test_IsReservedID(t *testing.T) {
+	old := ReservedIDs
+	defer func() { ReservedIDs = old }()
+
+	ReservedIDs = parseReservedIDs(" api, Ping ,,admin")
+	require.Len(t, ReservedIDs, 3)
+	require.True(t, IsReservedID("api"))
+	require.True(t, IsReservedID("PING"))
+	require.False(t, IsReservedID("spring-sale"))
+}
+
+func Test_setRedirectType(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Value   string
+		Want    int
+		WantErr bool
+	}{
+		{Name: "Moved permanently", Value: "301", Want: 301},
+		{Name: "Found", Value: "302", Want: 302},
+		{Name: "Permanent redirect", Value: "308", Want: 308},
+		{Name: "See other", Value: "303", WantErr: true},
+		{Name: "Not a number", Value: "permanent", WantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			old := RedirectType
+			defer func() { RedirectType = old }()
+
+			err := setRedirectType(tc.Value)
+			if tc.WantErr {
+				require.Error(t, err)
+				require.Equal(t, old, RedirectType)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.Want, RedirectType)
+		})
+	}
+}
+
+func Test_setTrustedProxies(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Value   string
+		Want    []string
+		WantErr bool
+	}{
+		{Name: "Networks", Value: "10.0.0.0/8, fd00::/8", Want: []string{"10.0.0.0/8", "fd00::/8"}},
+		{Name: "Addresses", Value: "192.0.2.1,2001:db8::1", Want: []string{"192.0.2.1/32", "2001:db8::1/128"}},
+		{Name: "Empty", Value: " , ", Want: []string{}},
+		{Name: "Host name", Value: "proxy.local", WantErr: true},
+		{Name: "Bad mask", Value: "10.0.0.0/33", WantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			old := TrustedProxies
+			defer func() { TrustedProxies = old }()
+
+			err := setTrustedProxies(tc.Value)
+			if tc.WantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			got := []string{}
+			for _, network := range TrustedProxies {
+				got = append(got, network.String())
+			}
+			require.Equal(t, tc.Want, got)
+		})
+	}
+}
@@ -2,31 +2,92 @@ package main
 
 import (
 	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
 	"io"
+	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/absurd678/skill/cmd/config"
+	"github.com/absurd678/skill/internal/auth"
+	"github.com/absurd678/skill/internal/deleter"
+	"github.com/absurd678/skill/internal/geoip"
+	"github.com/absurd678/skill/internal/health"
+	"github.com/absurd678/skill/internal/janitor"
+	"github.com/absurd678/skill/internal/lockout"
 	"github.com/absurd678/skill/internal/models"
+	"github.com/absurd678/skill/internal/storage"
+	"github.com/absurd678/skill/internal/useragent"
 	"github.com/go-chi/chi/v5"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var mapURLmain = map[string]string{
 	"sharaga": "https://mai.ru",
 }
 
+// paths of the single link API
+var (
+	apiURLRegexp     = regexp.MustCompile(`^/api/urls/[a-zA-Z0-9-]+$`)
+	apiHistoryRegexp = regexp.MustCompile(`^/api/urls/[a-zA-Z0-9-]+/history$`)
+	apiStatsRegexp   = regexp.MustCompile(`^/api/urls/[a-zA-Z0-9-]+/stats$`)
+)
+
+// /{id}/extra/path of a passthrough link
+var suffixPathRegexp = regexp.MustCompile(`^/[a-zA-Z0-9-]+/`)
+
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
-const shortURLsize int = 10
+const maxIDAttempts int = 10 // how many times to regenerate an {id} on collision
+const maxShortenAttempts = 3 // how many times to free the original URL of a used up, expired or closed link
+const pingTimeout = 3 * time.Second
+const shutdownTimeout = 10 * time.Second
+const maxBatchSize int = 10000 // URLs in one POST /api/shorten/batch
+const maxPageSize int = 1000   // links in one page of GET /api/user/urls, also the default
+const nextCursorHeader = "X-Next-Cursor"
+const maxPasswordLength int = 72              // bcrypt ignores the rest
+const maxVariants int = 100                   // destinations of one A/B link
+const maxRotation int = 100                   // destinations of one rotating link
+const maxDeviceRules int = 100                // device rules of one link
+const maxGeoRules int = 100                   // geo rules of one link
+const maxCountries int = 250                  // countries of one geo rule, there are fewer codes
+const maxURLLength int = 8192                 // bytes of any URL of a link
+const maxTTL int64 = 100 * 365 * 24 * 60 * 60 // seconds, a century; a Duration overflows at about three
+const maxBodySize int64 = 1 << 20             // bytes of a request body
+const maxBatchBodySize int64 = 128 << 20      // bytes of a batch request body, maxBatchSize long URLs fit
+const stickyVariantFor = 30 * 24 * time.Hour  // how long a visitor keeps the variant of a sticky link
 
 // ----------------------STRUCTURES----------------------------
 type (
 	Connection struct {
-		mapURL map[string]string
+		store       storage.Storage     // where the short -> original URL pairs live
+		auth        *auth.Authenticator // user cookies, a random secret if nil
+		deleter     *deleter.Deleter    // background deletion, started with defaults if nil
+		lockout     *lockout.Lockout    // wrong link passwords by link and client, defaults if nil
+		linkLockout *lockout.Lockout    // wrong link passwords by link from all clients, defaults if nil
+		geo         countryLocator      // country of the client for the geo rules, they are off if nil
+		health      *health.Checker     // failing original URLs, the fallback URLs are never used if nil
+		clock       func() time.Time    // time.Now if nil, the tests move it by hand
+	}
+
+	// countryLocator is *geoip.DB, the tests have their own
+	countryLocator interface {
+		Country(ip net.IP) (string, error)
 	}
 
 	// Logging
@@ -103,51 +164,726 @@ func (d *Decompress) Close() error {
 
 // RandString generates a random string with the given length
 func RandString(n int) string {
-	// rand.Seed is deprecated, use NewSource instead :D
-	r := rand.New(rand.NewSource(time.Now().Unix()))
+	// the global source is seeded randomly and safe for concurrent use,
+	// a new source seeded with the current second gave the same ids within a second
 	b := make([]byte, n)
 	for i := range b {
-		b[i] = letterBytes[r.Intn(len(letterBytes))]
+		b[i] = letterBytes[rand.Intn(len(letterBytes))]
 	}
 	return string(b)
 }
 
 // ------------------------Connection-----------------------------
+
+// now is the time the links are checked against
+func (c *Connection) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock()
+}
+
+// ownerID returns the ID of the user making the request ("" if unknown)
+func ownerID(ctx context.Context) string {
+	user, _ := auth.FromContext(ctx)
+	return user.ID
+}
+
+// saveNewURL stores the record under its alias (rec.ShortURL) if it is set,
+// otherwise under a freshly generated {id}, generating another one if the id is already taken
+func (c *Connection) saveNewURL(ctx context.Context, rec models.URLRecord) (string, error) {
+	rec.UserID = ownerID(ctx)
+	if rec.ShortURL != "" {
+		return rec.ShortURL, c.store.Save(ctx, rec)
+	}
+	for i := 0; i < maxIDAttempts; i++ {
+		rec.ShortURL = RandString(config.ShortURLLength)
+		if config.IsReservedID(rec.ShortURL) {
+			continue
+		}
+		err := c.store.Save(ctx, rec)
+		if errors.Is(err, storage.ErrShortURLExists) {
+			continue // collision, try another id
+		}
+		if err != nil {
+			return "", err
+		}
+		return rec.ShortURL, nil
+	}
+	return "", fmt.Errorf("no free short URL after %d attempts", maxIDAttempts)
+}
+
+// shortLink makes the absolute short URL out of the {id}
+func shortLink(shortURL string) string {
+	return config.BaseURL + shortURL
+}
+
+// shortenURL saves the record under a new id (or its alias) and returns the id with 201 Created,
+// or the existing id with 409 Conflict if the original URL is already shortened
+func (c *Connection) shortenURL(ctx context.Context, rec models.URLRecord) (string, int, error) {
+	for attempt := 1; ; attempt++ {
+		shortURL, err := c.saveNewURL(ctx, rec)
+		if !errors.Is(err, storage.ErrOriginalURLExists) {
+			if err != nil {
+				return "", 0, err
+			}
+			return shortURL, http.StatusCreated, nil
+		}
+		existing, err := c.store.GetByOriginal(ctx, rec.OriginalURL)
+		if errors.Is(err, storage.ErrNotFound) && attempt < maxShortenAttempts {
+			continue // freed by a parallel request in between
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		switch {
+		case attempt >= maxShortenAttempts:
+			return existing.ShortURL, http.StatusConflict, nil
+		case existing.Exhausted() || existing.Expired(c.now()) || existing.NoLongerActive(c.now()):
+			// a used up, expired or closed link doesn't redirect anymore, give the URL to the new one. The old link
+			// stays with its owner as it is till the janitor purges it, history and stats included (and its id
+			// answers 410 meanwhile); a parallel request may have released it already
+			if err = c.store.ReleaseOriginalURL(ctx, existing.ShortURL); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return "", 0, err
+			}
+		default:
+			return existing.ShortURL, http.StatusConflict, nil
+		}
+	}
+}
+
+// saveNewBatch stores all the original URLs under freshly generated ids in one go,
+// the whole batch gets new ids if any of them is taken
+func (c *Connection) saveNewBatch(ctx context.Context, originals []string) ([]string, error) {
+	recs := make([]models.URLRecord, len(originals))
+	for i := 0; i < maxIDAttempts; i++ {
+		for j, original := range originals {
+			recs[j] = models.URLRecord{ShortURL: RandString(config.ShortURLLength), OriginalURL: original, UserID: ownerID(ctx)}
+			for config.IsReservedID(recs[j].ShortURL) {
+				recs[j].ShortURL = RandString(config.ShortURLLength)
+			}
+		}
+		err := c.store.SaveBatch(ctx, recs)
+		if errors.Is(err, storage.ErrShortURLExists) {
+			continue // collision, try other ids
+		}
+		if err != nil {
+			return nil, err
+		}
+		shortURLs := make([]string, len(recs))
+		for j := range recs {
+			shortURLs[j] = recs[j].ShortURL
+		}
+		return shortURLs, nil
+	}
+	return nil, fmt.Errorf("no free short URLs after %d attempts", maxIDAttempts)
+}
+
 func (c *Connection) GetHandler(res http.ResponseWriter, req *http.Request) {
 	// take /{id} and search for value in the map
-	shortURL := chi.URLParam(req, "id")
-	original, ok := c.mapURL[shortURL]
+	rec, ok := c.liveRecord(res, req)
 	if !ok {
+		return
+	}
+	if rec.PasswordHash != "" {
+		writePasswordForm(res, http.StatusOK, false)
+		return
+	}
+	c.redirect(res, req, rec, redirectStatus(rec))
+}
+
+// deviceTarget is the URL of the first rule matching the client or the original URL if none does
+func deviceTarget(rec models.URLRecord, client useragent.Info) (string, bool) {
+	for _, rule := range rec.DeviceRules {
+		if (rule.OS == "" || rule.OS == client.OS) && (rule.Device == "" || rule.Device == client.Device) {
+			return rule.URL, true
+		}
+	}
+	return rec.OriginalURL, false
+}
+
+// geoTarget is the URL of the first rule with the country of the client or the original URL if none has it
+func (c *Connection) geoTarget(req *http.Request, rec models.URLRecord) (string, bool) {
+	country, err := c.geo.Country(geoip.ClientIP(req, config.TrustedProxies))
+	if err != nil {
+		log.Printf("country of %s: %s", req.RemoteAddr, err) // the visitor gets the original URL
+	}
+	if country == "" {
+		return rec.OriginalURL, false
+	}
+	for _, rule := range rec.GeoRules {
+		if slices.Contains(rule.Countries, country) {
+			return rule.URL, true
+		}
+	}
+	return rec.OriginalURL, false
+}
+
+// variantCookie keeps the variant of a sticky A/B link, one cookie per link
+func variantCookie(shortURL string) string {
+	return "ab_" + shortURL
+}
+
+// pickVariant returns the index of the variant for the visitor: the one from the cookie
+// of a sticky link if it is still there, otherwise a random one by weight
+func pickVariant(res http.ResponseWriter, req *http.Request, rec models.URLRecord) int {
+	if rec.Sticky {
+		if cookie, err := req.Cookie(variantCookie(rec.ShortURL)); err == nil {
+			if i, err := strconv.Atoi(cookie.Value); err == nil && i >= 0 && i < len(rec.Variants) && rec.Variants[i].Weight > 0 {
+				return i
+			}
+		}
+	}
+	total := 0
+	for _, v := range rec.Variants {
+		total += v.Weight
+	}
+	n, picked := rand.Intn(total), 0
+	for i, v := range rec.Variants {
+		if n < v.Weight {
+			picked = i
+			break
+		}
+		n -= v.Weight
+	}
+	if rec.Sticky {
+		http.SetCookie(res, &http.Cookie{
+			Name:     variantCookie(rec.ShortURL),
+			Value:    strconv.Itoa(picked),
+			Path:     "/",
+			MaxAge:   int(stickyVariantFor / time.Second),
+			HttpOnly: true,
+		})
+	}
+	return picked
+}
+
+// checkVariants tells what is wrong with the A/B variants from a request, nil if nothing
+func checkVariants(variants []models.Variant, sticky bool) error {
+	if sticky && len(variants) == 0 {
+		return errors.New("sticky needs variants")
+	}
+	if len(variants) > maxVariants {
+		return fmt.Errorf("up to %d variants", maxVariants)
+	}
+	total := 0
+	for i, v := range variants {
+		if v.URL == "" {
+			return fmt.Errorf("variant %d has no url", i)
+		}
+		if v.Weight < 0 {
+			return fmt.Errorf("variant %d has a negative weight", i)
+		}
+		total += v.Weight
+	}
+	if len(variants) > 0 && total == 0 {
+		return errors.New("the weights of the variants add up to 0")
+	}
+	return nil
+}
+
+// checkRotation tells what is wrong with the rotation from a request, nil if nothing
+func checkRotation(rotation []string, variants []models.Variant) error {
+	if len(rotation) > 0 && len(variants) > 0 {
+		return errors.New("set either variants or rotation, not both")
+	}
+	if len(rotation) > maxRotation {
+		return fmt.Errorf("up to %d rotation URLs", maxRotation)
+	}
+	for i, u := range rotation {
+		if u == "" {
+			return fmt.Errorf("rotation URL %d is empty", i)
+		}
+		if _, err := url.Parse(u); err != nil {
+			return fmt.Errorf("rotation URL %d: %w", i, err) // it is only known to the redirect after the step is taken
+		}
+	}
+	return nil
+}
+
+// checkURLLengths tells which URL of a request is longer than maxURLLength, nil if none
+func checkURLLengths(some_url models.SomeURL) error {
+	urls := []string{some_url.URL, some_url.PrelaunchURL, some_url.PostExpiryURL, some_url.FallbackURL}
+	for _, rule := range some_url.DeviceRules {
+		urls = append(urls, rule.URL)
+	}
+	for _, rule := range some_url.GeoRules {
+		urls = append(urls, rule.URL)
+	}
+	for _, v := range some_url.Variants {
+		urls = append(urls, v.URL)
+	}
+	urls = append(urls, some_url.Rotation...)
+	for _, u := range urls {
+		if len(u) > maxURLLength {
+			return fmt.Errorf("URLs must be up to %d bytes", maxURLLength)
+		}
+	}
+	return nil
+}
+
+// limitBody caps the size of the request bodies, the decompressed ones too: every saved link
+// becomes a line in the file storage that has to be read back on start
+func limitBody(size int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			req.Body = http.MaxBytesReader(res, req.Body, size)
+			next.ServeHTTP(res, req)
+		})
+	}
+}
+
+// checkDeviceRules tells what is wrong with the rules from a request, nil if nothing
+func checkDeviceRules(rules []models.DeviceRule) error {
+	if len(rules) > maxDeviceRules {
+		return fmt.Errorf("up to %d device rules", maxDeviceRules)
+	}
+	for i, rule := range rules {
+		switch {
+		case rule.URL == "":
+			return fmt.Errorf("device rule %d has no url", i)
+		case rule.OS == "" && rule.Device == "":
+			return fmt.Errorf("device rule %d needs os or device", i)
+		case rule.OS != "" && !slices.Contains(useragent.OSes, rule.OS):
+			return fmt.Errorf("device rule %d: os must be one of %s", i, strings.Join(useragent.OSes, ", "))
+		case rule.Device != "" && !slices.Contains(useragent.Devices, rule.Device):
+			return fmt.Errorf("device rule %d: device must be one of %s", i, strings.Join(useragent.Devices, ", "))
+		}
+	}
+	return nil
+}
+
+// checkGeoRules tells what is wrong with the geo rules from a request, nil if nothing.
+// The country codes are upper cased in place
+func checkGeoRules(rules []models.GeoRule) error {
+	if len(rules) > maxGeoRules {
+		return fmt.Errorf("up to %d geo rules", maxGeoRules)
+	}
+	for i, rule := range rules {
+		if rule.URL == "" {
+			return fmt.Errorf("geo rule %d has no url", i)
+		}
+		if len(rule.Countries) == 0 || len(rule.Countries) > maxCountries {
+			return fmt.Errorf("geo rule %d must have 1 to %d countries", i, maxCountries)
+		}
+		for j, country := range rule.Countries {
+			country = strings.ToUpper(country)
+			if len(country) != 2 || country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z' {
+				return fmt.Errorf("geo rule %d: %q is not a two letter country code", i, rule.Countries[j])
+			}
+			rule.Countries[j] = country
+		}
+	}
+	return nil
+}
+
+// pathSuffix is the escaped path after /{id}/, empty for /{id} itself
+func pathSuffix(req *http.Request) string {
+	rest := strings.TrimPrefix(req.URL.EscapedPath(), "/"+chi.URLParam(req, "id"))
+	return strings.TrimPrefix(rest, "/")
+}
+
+// passthroughURL appends the path suffix to the path of the original URL and adds the incoming
+// query to its query. On a key collision the original URL wins: its parameters (the UTM template ones
+// too) are kept as they are and the incoming values of the same key are dropped
+func passthroughURL(original, suffix string, query url.Values) (string, error) {
+	u, err := url.Parse(original)
+	if err != nil {
+		return "", err
+	}
+	if suffix != "" {
+		if err = checkSuffix(suffix); err != nil {
+			return "", err
+		}
+		rawPath := strings.TrimSuffix(u.EscapedPath(), "/") + "/" + suffix
+		if u.Path, err = url.PathUnescape(rawPath); err != nil {
+			return "", errors.New("Invalid path suffix")
+		}
+		u.RawPath = rawPath
+	}
+	addQuery(u, query)
+	return u.String(), nil
+}
+
+// checkSuffix tells whether the path suffix may be added to a destination
+func checkSuffix(suffix string) error {
+	for _, segment := range strings.Split(suffix, "/") {
+		if segment, err := url.PathUnescape(segment); err != nil || segment == "." || segment == ".." {
+			return errors.New("Invalid path suffix")
+		}
+	}
+	return nil
+}
+
+// addQuery appends the parameters the URL doesn't have yet, the existing ones stay as they are
+func addQuery(u *url.URL, query url.Values) {
+	own := u.Query()
+	extra := url.Values{}
+	for key, values := range query {
+		if _, ok := own[key]; !ok {
+			extra[key] = values
+		}
+	}
+	if len(extra) > 0 {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += extra.Encode()
+	}
+}
+
+// withUTM adds the parameters of the template to the original URL
+func withUTM(original string, tpl models.UTMTemplate) (string, error) {
+	u, err := url.Parse(original)
+	if err != nil {
+		return "", err
+	}
+	addQuery(u, tpl.Query())
+	return u.String(), nil
+}
+
+// fallbackRedirect sends the client to the fallback URL, it is temporary by nature and never cached.
+// A posted form is followed with GET, the password must not go to the fallback URL
+func fallbackRedirect(res http.ResponseWriter, req *http.Request, location string) {
+	status := http.StatusTemporaryRedirect
+	if req.Method == http.MethodPost {
+		status = http.StatusSeeOther
+	}
+	res.Header().Set("Location", location)
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(status)
+}
+
+// checkActiveWindow tells what is wrong with the active window from a request, nil if nothing
+func checkActiveWindow(some_url models.SomeURL, now time.Time) error {
+	switch {
+	case some_url.ActiveUntil != nil && !some_url.ActiveUntil.After(now):
+		return errors.New("active_until must be in the future")
+	case some_url.ActiveFrom != nil && some_url.ActiveUntil != nil && !some_url.ActiveUntil.After(*some_url.ActiveFrom):
+		return errors.New("active_until must be after active_from")
+	case some_url.PrelaunchURL != "" && some_url.ActiveFrom == nil:
+		return errors.New("prelaunch_url needs active_from")
+	case some_url.PostExpiryURL != "" && some_url.ActiveUntil == nil:
+		return errors.New("post_expiry_url needs active_until")
+	}
+	return nil
+}
+
+// redirectStatus is the redirect type of the link or the server default
+func redirectStatus(rec models.URLRecord) int {
+	if rec.RedirectType != 0 {
+		return rec.RedirectType
+	}
+	return config.RedirectType
+}
+
+// cacheControl lets the clients cache a permanent redirect, unless every click must reach the server,
+// the destination depends on the client address or the health of the original URL, or the link
+// expires sooner. The rest are never cached. A private response (one setting a cookie) is cached
+// by the client only, a shared cache would hand the cookie to everybody else
+func cacheControl(rec models.URLRecord, status int, now time.Time, private bool) string {
+	if status != http.StatusMovedPermanently && status != http.StatusPermanentRedirect {
+		return "no-store"
+	}
+	if rec.ClicksLeft != nil || rec.PasswordHash != "" || len(rec.Variants) > 0 || len(rec.Rotation) > 0 || len(rec.GeoRules) > 0 || rec.FallbackURL != "" {
+		return "no-store"
+	}
+	maxAge := config.PermanentRedirectMaxAge
+	if rec.ExpiresAt != nil {
+		maxAge = min(maxAge, rec.ExpiresAt.Sub(now))
+	}
+	if rec.ActiveUntil != nil {
+		maxAge = min(maxAge, rec.ActiveUntil.Sub(now))
+	}
+	if maxAge < time.Second {
+		return "no-store"
+	}
+	scope := "public"
+	if private {
+		scope = "private"
+	}
+	return fmt.Sprintf("%s, max-age=%d", scope, int(maxAge/time.Second))
+}
+
+// liveRecord finds the record of /{id} that can redirect now, otherwise it writes the error
+// (or the redirect to the fallback URL of a link outside its active window)
+func (c *Connection) liveRecord(res http.ResponseWriter, req *http.Request) (models.URLRecord, bool) {
+	rec, err := c.store.Get(req.Context(), chi.URLParam(req, "id"))
+	if errors.Is(err, storage.ErrNotFound) {
 		res.WriteHeader(http.StatusBadRequest) // DOESN'T WORK to fill code field for logResponse
 		res.Write([]byte("Invalid URL for GET"))
-		return
+		return rec, false
+	}
+	if err != nil {
+		http.Error(res, "Storage error", http.StatusInternalServerError)
+		return rec, false
+	}
+	if pathSuffix(req) != "" && !rec.Passthrough {
+		http.Error(res, "Invalid URL", http.StatusBadRequest)
+		return rec, false
+	}
+	if rec.DeletedFlag {
+		http.Error(res, "The short URL has been deleted", http.StatusGone)
+		return rec, false
+	}
+	now := c.now()
+	if rec.Expired(now) {
+		http.Error(res, "The short URL has expired", http.StatusGone)
+		return rec, false
+	}
+	if rec.NotYetActive(now) {
+		if rec.PrelaunchURL != "" {
+			fallbackRedirect(res, req, rec.PrelaunchURL)
+			return rec, false
+		}
+		http.Error(res, "The short URL is not active yet", http.StatusNotFound)
+		return rec, false
+	}
+	if rec.NoLongerActive(now) {
+		if rec.PostExpiryURL != "" {
+			fallbackRedirect(res, req, rec.PostExpiryURL)
+			return rec, false
+		}
+		http.Error(res, "The short URL is no longer active", http.StatusGone)
+		return rec, false
+	}
+	if rec.Exhausted() {
+		http.Error(res, "The short URL has been used up", http.StatusGone)
+		return rec, false
+	}
+	return rec, true
+}
+
+// redirect sends the client to the original URL, spending a click of a click-limited link
+func (c *Connection) redirect(res http.ResponseWriter, req *http.Request, rec models.URLRecord, status int) {
+	location, targeted, variant := rec.OriginalURL, false, -1
+	if len(rec.DeviceRules) > 0 {
+		res.Header().Add("Vary", "User-Agent") // the caches must not give one device the URL of another
+		location, targeted = deviceTarget(rec, useragent.Parse(req.UserAgent()))
+	}
+	if !targeted && len(rec.GeoRules) > 0 && c.geo != nil {
+		location, targeted = c.geoTarget(req, rec)
+	}
+	if !targeted && len(rec.Variants) > 0 {
+		variant = pickVariant(res, req, rec)
+		location = rec.Variants[variant].URL
+	}
+	// the rotation step is taken last, a redirect that fails must not use it up
+	rotating := !targeted && len(rec.Rotation) > 0
+	var tpl *models.UTMTemplate
+	if rec.UTMTemplate != "" {
+		t, err := c.store.GetUTMTemplate(req.Context(), rec.UserID, rec.UTMTemplate)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			http.Error(res, "Storage error", http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			tpl = &t
+		}
+	}
+	if rec.Passthrough {
+		if err := checkSuffix(pathSuffix(req)); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !rotating {
+		var ok bool
+		if location, status, ok = c.destination(res, req, rec, tpl, location, status); !ok {
+			return
+		}
+	}
+	if rec.ClicksLeft != nil {
+		// click-limited, only the storage knows for sure whether this click is still there
+		var err error
+		rec, err = c.store.UseClick(req.Context(), rec.ShortURL)
+		if errors.Is(err, storage.ErrNoClicksLeft) {
+			http.Error(res, "The short URL has been used up", http.StatusGone)
+			return
+		}
+		if err != nil {
+			http.Error(res, "Storage error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if rotating {
+		// the storage hands out the steps, so parallel redirects and restarts keep the order
+		n, err := c.store.NextRotation(req.Context(), rec.ShortURL)
+		if err != nil {
+			http.Error(res, "Storage error", http.StatusInternalServerError)
+			return
+		}
+		var ok bool
+		location = rec.Rotation[n%int64(len(rec.Rotation))]
+		if location, status, ok = c.destination(res, req, rec, tpl, location, status); !ok {
+			return
+		}
+	}
+	if variant >= 0 {
+		if err := c.store.AddVariantClick(req.Context(), rec.ShortURL, variant); err != nil {
+			log.Printf("variant click of %s: %s", rec.ShortURL, err) // the visitor gets there anyway
+		}
 	}
 
 	// Add the Location header with original URL
-	res.Header().Add("Location", original) // No location actually sent. However the header is added.
-	res.WriteHeader(http.StatusTemporaryRedirect)
+	res.Header().Add("Location", location) // No location actually sent. However the header is added.
+	// a new visitor gets the user cookie with the redirect
+	setsCookie := len(res.Header().Values("Set-Cookie")) > 0
+	res.Header().Set("Cache-Control", cacheControl(rec, status, c.now(), setsCookie))
+	res.WriteHeader(status)
 	res.Write([]byte(""))
 }
 
+// destination swaps a failing original URL for the fallback and adds the UTM parameters and the
+// passthrough path and query to the location, the error is written to res when it can't be done
+func (c *Connection) destination(res http.ResponseWriter, req *http.Request, rec models.URLRecord,
+	tpl *models.UTMTemplate, location string, status int) (string, int, bool) {
+	if location == rec.OriginalURL && rec.FallbackURL != "" && c.health != nil && !c.health.Healthy(rec.OriginalURL) {
+		// the original URL is failing, the fallback is temporary by nature
+		location = rec.FallbackURL
+		if status != http.StatusSeeOther {
+			status = http.StatusTemporaryRedirect
+		}
+	}
+	var err error
+	if tpl != nil {
+		if location, err = withUTM(location, *tpl); err != nil {
+			http.Error(res, "Invalid original URL", http.StatusInternalServerError)
+			return "", 0, false
+		}
+	}
+	if rec.Passthrough {
+		if location, err = passthroughURL(location, pathSuffix(req), req.URL.Query()); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return "", 0, false
+		}
+	}
+	return location, status, true
+}
+
+// passwordForm asks for the password of a protected link, it is posted back to the same /{id}
+var passwordForm = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Password required</title></head>
+<body>
+<form method="post">
+{{if .}}<p>Wrong password</p>{{end}}
+<label>Password <input type="password" name="password" required autofocus></label>
+<button type="submit">Open</button>
+</form>
+</body>
+</html>
+`))
+
+func writePasswordForm(res http.ResponseWriter, status int, wrong bool) {
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(status)
+	passwordForm.Execute(res, wrong)
+}
+
+// clientNetwork is what the lockout counts the wrong passwords of a client for: its IPv4 address
+// or its IPv6 /64, since a single client usually has the whole network
+func clientNetwork(req *http.Request) string {
+	ip := geoip.ClientIP(req, config.TrustedProxies)
+	if ip == nil {
+		return req.RemoteAddr
+	}
+	if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 8*net.IPv6len)).String() + "/64"
+	}
+	return ip.String()
+}
+
+// PostPasswordHandler checks the password posted by the form of a protected link
+func (c *Connection) PostPasswordHandler(res http.ResponseWriter, req *http.Request) {
+	rec, ok := c.liveRecord(res, req)
+	if !ok {
+		return
+	}
+	if rec.PasswordHash == "" {
+		http.Error(res, "The short URL has no password", http.StatusBadRequest)
+		return
+	}
+	// a client guessing from many addresses still runs out of the budget of the link
+	key := rec.ShortURL + " " + clientNetwork(req)
+	if wait := max(c.lockout.Locked(key), c.linkLockout.Locked(rec.ShortURL)); wait > 0 {
+		tooManyAttempts(res, wait)
+		return
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(rec.PasswordHash), []byte(req.PostFormValue("password")))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		if wait := max(c.lockout.Fail(key), c.linkLockout.Fail(rec.ShortURL)); wait > 0 {
+			tooManyAttempts(res, wait)
+			return
+		}
+		writePasswordForm(res, http.StatusForbidden, true)
+		return
+	}
+	if err != nil {
+		http.Error(res, "Broken password hash", http.StatusInternalServerError)
+		return
+	}
+	c.lockout.Reset(key)
+	c.linkLockout.Forgive(rec.ShortURL)
+	c.redirect(res, req, rec, http.StatusSeeOther) // the browser follows with GET, not the posted form
+}
+
+func tooManyAttempts(res http.ResponseWriter, wait time.Duration) {
+	res.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second)/time.Second)))
+	http.Error(res, "Too many wrong passwords, try again later", http.StatusTooManyRequests)
+}
+
 func (c *Connection) PostHandler(res http.ResponseWriter, req *http.Request) {
 	// Get the URL from the body (and the new id also) like this: localhost:8080 -d https://example
 	original, err := io.ReadAll(req.Body)
-	if err != nil {
+	if err != nil || len(original) > maxURLLength {
 		res.WriteHeader(http.StatusBadRequest) // to fill code field for logResponse
 		res.Write([]byte("Invalid URL for POST"))
 		return
 	}
-	// get the new id from the b flag
-	c.mapURL[config.UrlID] = string(original)
+	// generate the new id (or take the existing one)
+	shortURL, status, err := c.shortenURL(req.Context(), models.URLRecord{OriginalURL: string(original)})
+	if err != nil {
+		http.Error(res, "Storage error", http.StatusInternalServerError)
+		return
+	}
 
-	res.WriteHeader(http.StatusCreated)
-	// Body answer: localhost:8080/{id}
-	res.Write([]byte(req.URL.Path + config.UrlID))
+	res.WriteHeader(status)
+	// Body answer: http://localhost:8080/{id}
+	res.Write([]byte(shortLink(shortURL)))
+}
+
+// expiryOf returns the expiration moment from ttl or expires_at (nil if neither is set)
+func expiryOf(some_url models.SomeURL, now time.Time) (*time.Time, error) {
+	switch {
+	case some_url.TTL != 0 && some_url.ExpiresAt != nil:
+		return nil, errors.New("set either ttl or expires_at, not both")
+	case some_url.TTL < 0 || some_url.TTL > maxTTL:
+		return nil, fmt.Errorf("ttl must be 1 to %d seconds", maxTTL)
+	case some_url.TTL > 0:
+		expiresAt := now.Add(time.Duration(some_url.TTL) * time.Second).UTC()
+		return &expiresAt, nil
+	case some_url.ExpiresAt != nil:
+		if !some_url.ExpiresAt.After(now) {
+			return nil, errors.New("expires_at must be in the future")
+		}
+		expiresAt := some_url.ExpiresAt.UTC()
+		return &expiresAt, nil
+	}
+	return nil, nil
 }
 
 func (c *Connection) PostHandlerJSON(res http.ResponseWriter, req *http.Request) {
-	// get json: {"url": "some_url"}
-	// return json: {"result": "short_url"}
+	// get json: {"url": "some_url", "alias": "optional-id", "ttl": 3600 or "expires_at": "2030-01-01T00:00:00Z",
+	// "max_clicks": 1, "password": "optional secret", "redirect_type": 301, "passthrough": true,
+	// "utm_template": "name", "device_rules": [{"os": "ios", "device": "mobile", "url": "https://..."}, ...],
+	// "geo_rules": [{"countries": ["DE", "AT"], "url": "https://..."}, ...],
+	// "variants": [{"url": "https://a...", "weight": 70}, {"url": "https://b...", "weight": 30}], "sticky": true,
+	// or "rotation": ["https://mirror1...", "https://mirror2...", ...],
+	// "active_from": "2030-01-01T00:00:00Z", "prelaunch_url": "https://...", "active_until": "...", "post_expiry_url": "...",
+	// "fallback_url": "https://mirror..."}
+	// return json: {"result": "http://localhost:8080/short_url"}
 	var some_url models.SomeURL
 	var short_url models.ShortURL
 	var buff []byte
@@ -157,17 +893,455 @@ func (c *Connection) PostHandlerJSON(res http.ResponseWriter, req *http.Request)
 		res.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	short_url = models.ShortURL{URL: config.UrlID}
-	c.mapURL[short_url.URL] = some_url.URL
-	res.WriteHeader(http.StatusCreated)
+	if err = checkURLLengths(some_url); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := expiryOf(some_url, c.now())
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if some_url.MaxClicks < 0 {
+		http.Error(res, "max_clicks must be positive", http.StatusBadRequest)
+		return
+	}
+	if some_url.RedirectType != 0 && !config.IsRedirectType(some_url.RedirectType) {
+		http.Error(res, "redirect_type must be 301, 302, 307 or 308", http.StatusBadRequest)
+		return
+	}
+	if err = checkDeviceRules(some_url.DeviceRules); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(some_url.GeoRules) > 0 && c.geo == nil {
+		http.Error(res, "Geo rules need a GeoIP database on the server", http.StatusBadRequest)
+		return
+	}
+	if err = checkGeoRules(some_url.GeoRules); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = checkVariants(some_url.Variants, some_url.Sticky); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = checkRotation(some_url.Rotation, some_url.Variants); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = checkActiveWindow(some_url, c.now()); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if some_url.FallbackURL != "" && some_url.FallbackURL == some_url.URL {
+		http.Error(res, "fallback_url must differ from url", http.StatusBadRequest)
+		return
+	}
+	if some_url.FallbackURL != "" && c.health != nil {
+		// the url is going to be probed by the server
+		if err = c.health.CheckDestination(req.Context(), some_url.URL); err != nil {
+			http.Error(res, "url: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if some_url.UTMTemplate != "" {
+		_, err = c.store.GetUTMTemplate(req.Context(), ownerID(req.Context()), some_url.UTMTemplate)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(res, "Unknown UTM template", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(res, "Storage error", http.StatusInternalServerError)
+			return
+		}
+	}
+	var clicksLeft *int64
+	if some_url.MaxClicks > 0 {
+		clicksLeft = &some_url.MaxClicks
+	}
+	var passwordHash []byte
+	if some_url.Password != "" {
+		if len(some_url.Password) > maxPasswordLength {
+			http.Error(res, fmt.Sprintf("Password must be up to %d bytes", maxPasswordLength), http.StatusBadRequest)
+			return
+		}
+		if passwordHash, err = bcrypt.GenerateFromPassword([]byte(some_url.Password), bcrypt.DefaultCost); err != nil {
+			http.Error(res, "Password hashing error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if some_url.Alias != "" {
+		if !config.IDRegexp.MatchString(some_url.Alias) || len(some_url.Alias) > config.MaxShortURLLength {
+			http.Error(res, fmt.Sprintf("Alias must be up to %d letters, digits or '-'", config.MaxShortURLLength), http.StatusBadRequest)
+			return
+		}
+		if config.IsReservedID(some_url.Alias) {
+			http.Error(res, "The alias is reserved", http.StatusConflict)
+			return
+		}
+	}
+
+	shortID, status, err := c.shortenURL(req.Context(), models.URLRecord{
+		ShortURL:      some_url.Alias,
+		OriginalURL:   some_url.URL,
+		ExpiresAt:     expiresAt,
+		ClicksLeft:    clicksLeft,
+		PasswordHash:  string(passwordHash),
+		RedirectType:  some_url.RedirectType,
+		Passthrough:   some_url.Passthrough,
+		UTMTemplate:   some_url.UTMTemplate,
+		DeviceRules:   some_url.DeviceRules,
+		GeoRules:      some_url.GeoRules,
+		Variants:      some_url.Variants,
+		Sticky:        some_url.Sticky,
+		Rotation:      some_url.Rotation,
+		ActiveFrom:    some_url.ActiveFrom,
+		ActiveUntil:   some_url.ActiveUntil,
+		PrelaunchURL:  some_url.PrelaunchURL,
+		PostExpiryURL: some_url.PostExpiryURL,
+		FallbackURL:   some_url.FallbackURL,
+	})
+	if errors.Is(err, storage.ErrShortURLExists) { // only an alias can be taken
+		http.Error(res, "The alias is already taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(res, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	short_url = models.ShortURL{URL: shortLink(shortID)}
 	if buff, err = json.MarshalIndent(short_url, "", " "); err != nil {
-		res.WriteHeader(http.StatusBadRequest)
-		res.Write([]byte("Unmarshable data"))
+		http.Error(res, "Unmarshable data", http.StatusInternalServerError)
 		return
 	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status) // 201 or 409 with the existing short URL
 	res.Write(buff)
 }
 
+func (c *Connection) PostHandlerBatch(res http.ResponseWriter, req *http.Request) {
+	// get json: [{"correlation_id": "1", "original_url": "some_url"}, ...]
+	// return json: [{"correlation_id": "1", "short_url": "short_url"}, ...]
+	var batch []models.BatchRequestItem
+	var buff []byte
+	var err error
+
+	if err = json.NewDecoder(req.Body).Decode(&batch); err != nil {
+		http.Error(res, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(batch) == 0 || len(batch) > maxBatchSize {
+		http.Error(res, fmt.Sprintf("Batch must have 1 to %d URLs", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+	originals := make([]string, len(batch))
+	for i, item := range batch {
+		if item.CorrelationID == "" || item.OriginalURL == "" {
+			http.Error(res, "Empty correlation_id or original_url", http.StatusBadRequest)
+			return
+		}
+		if len(item.OriginalURL) > maxURLLength {
+			http.Error(res, fmt.Sprintf("URLs must be up to %d bytes", maxURLLength), http.StatusBadRequest)
+			return
+		}
+		originals[i] = item.OriginalURL
+	}
+
+	shortURLs, err := c.saveNewBatch(req.Context(), originals)
+	if errors.Is(err, storage.ErrOriginalURLExists) {
+		http.Error(res, "Some URL is already shortened", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(res, "Storage error", http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]models.BatchResponseItem, len(batch))
+	for i, item := range batch {
+		result[i] = models.BatchResponseItem{CorrelationID: item.CorrelationID, ShortURL: shortLink(shortURLs[i])}
+	}
+	if buff, err = json.Marshal(result); err != nil {
+		http.Error(res, "Unmarshable data", http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusCreated)
+	res.Write(buff)
+}
+
+// requireUser returns the user from a valid cookie of the request,
+// or answers 401 if there was none
+func requireUser(res http.ResponseWriter, req *http.Request) (auth.User, bool) {
+	user, ok := auth.FromContext(req.Context())
+	if !ok || user.New { // no valid cookie came with the request
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return auth.User{}, false
+	}
+	return user, true
+}
+
+// ownedRecord returns the record of /api/urls/{id} if it belongs to the user from the cookie,
+// otherwise answers 401, 403, 404 or 410
+func (c *Connection) ownedRecord(res http.ResponseWriter, req *http.Request) (models.URLRecord, bool) {
+	user, ok := requireUser(res, req)
+	if !ok {
+		return models.URLRecord{}, false
+	}
+	rec, err := c.store.Get(req.Context(), chi.URLParam(req, "id"))
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(res, "No such short URL", http.StatusNotFound)
+		return models.URLRecord{}, false
+	}
+	if err != nil {
+		http.Error(res, "Storage error", http.StatusInternalServerError)
+		return models.URLRecord{}, false
+	}
+	if rec.UserID != user.ID {
+		http.Error(res, "The short URL belongs to another user", http.StatusForbidden)
+		return models.URLRecord{}, false
+	}
+	if rec.DeletedFlag {
+		http.Error(res, "The short URL has been deleted", http.StatusGone)
+		return models.URLRecord{}, false
+	}
+	return rec, true
+}
+
+// writeJSON answers with the value as JSON
+func writeJSON(res http.ResponseWriter, status int, v any) {
+	buff, err := json.Marshal(v)
+	if err != nil {
+		http.Error(res, "Unmarshable data", http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(buff)
+}
+
+func (c *Connection) PatchURLHandler(res http.ResponseWriter, req *http.Request) {
+	// get json: {"url": "new_url"}
+	// return json: {"short_url": "...", "original_url": "new_url"}
+	var some_url models.SomeURL
+
+	rec, ok := c.ownedRecord(res, req)
+	if !ok {
+		return
+	}
+	if err := json.NewDecoder(req.Body).Decode(&some_url); err != nil || some_url.URL == "" {
+		http.Error(res, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(some_url.URL) > maxURLLength {
+		http.Error(res, fmt.Sprintf("URLs must be up to %d bytes", maxURLLength), http.StatusBadRequest)
+		return
+	}
+
+	rec, err := c.store.UpdateOriginalURL(req.Context(), rec.UserID, rec.ShortURL, some_url.URL)
+	if errors.Is(err, storage.ErrOriginalURLExists) {
+		http.Error(res, "The URL is already shortened", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, storage.ErrNotFound) { // deleted in between
+		http.Error(res, "The short URL has been deleted", http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(res, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, http.StatusOK, models.UserURL{ShortURL: shortLink(rec.ShortURL), OriginalURL: rec.OriginalURL})
+}
+
+func (c *Connection) GetHistoryHandler(res http.ResponseWriter, req *http.Request) {
+	// return json: {"short_url": "...", "original_url": "current", "history": [{"revision": 1, ...}]}
+	rec, ok := c.ownedRecord(res, req)
+	if !ok {
+		return
+	}
+	history, err := c.store.History(req.Context(), rec.ShortURL)
+	if err != nil {
+		http.Error(res, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	if history == nil {
+		history = []models.URLRevision{} // [] rather than null
+	}
+	writeJSON(res, http.StatusOK, models.URLHistory{
+		ShortURL:    shortLink(rec.ShortURL),
+		OriginalURL: rec.OriginalURL,
+		History:     history,
+	})
+}
+
+func (c *Connection) GetUserURLsHandler(res http.ResponseWriter, req *http.Request) {
+	// return json: [{"short_url": "...", "original_url": "..."}, ...] of the user from the cookie
+	// ?limit=N&cursor=X for paging, the cursor of the next page is in the X-Next-Cursor header
+	var buff []byte
+	var err error
+
+	user, ok := requireUser(res, req)
+	if !ok {
+		return
+	}
+
+	limit := maxPageSize
+	if s := req.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 || limit > maxPageSize {
+			http.Error(res, fmt.Sprintf("limit must be 1..%d", maxPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+	after, err := base64.RawURLEncoding.DecodeString(req.URL.Query().Get("cursor"))
+	if err != nil {
+		http.Error(res, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+
+	recs, err := c.store.ListByUser(req.Context(), user.ID, string(after), limit+1) // one more to know there is a next page
+	if err != nil {
+		http.Error(res, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	if len(recs) == 0 {
+		res.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if len(recs) > limit {
+		recs = recs[:limit]
+		res.Header().Set(nextCursorHeader, base64.RawURLEncoding.EncodeToString([]byte(recs[limit-1].ShortURL)))
+	}
+
+	result := make([]models.UserURL, len(recs))
+	for i, rec := range recs {
+		result[i] = models.UserURL{ShortURL: shortLink(rec.ShortURL), OriginalURL: rec.OriginalURL}
+	}
+	if buff, err = json.Marshal(result); err != nil {
+		http.Error(res, "Unmarshable data", http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(buff)
+}
+
+func (c *Connection) DeleteUserURLsHandler(res http.ResponseWriter, req *http.Request) {
+	// get json: ["short_id1", "short_id2", ...] and delete the ones of the user in background
+	var shortURLs []string
+
+	user, ok := requireUser(res, req)
+	if !ok {
+		return
+	}
+	if err := json.NewDecoder(req.Body).Decode(&shortURLs); err != nil {
+		http.Error(res, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(shortURLs) == 0 || len(shortURLs) > maxBatchSize {
+		http.Error(res, fmt.Sprintf("Must be 1 to %d short URLs", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+	for _, short := range shortURLs {
+		if !config.IDRegexp.MatchString(short) {
+			http.Error(res, fmt.Sprintf("Invalid short URL id: %q", short), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := c.deleter.Enqueue(req.Context(), user.ID, shortURLs); err != nil {
+		http.Error(res, "Deletion is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	res.WriteHeader(http.StatusAccepted)
+}
+
+func (c *Connection) GetStatsHandler(res http.ResponseWriter, req *http.Request) {
+	// return json: {"short_url": "...", "original_url": "...", "variants": [{"url": "...", "weight": 70, "clicks": 12}]}
+	rec, ok := c.ownedRecord(res, req)
+	if !ok {
+		return
+	}
+	clicks, err := c.store.VariantClicks(req.Context(), rec.ShortURL)
+	if err != nil {
+		http.Error(res, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	stats := models.URLStats{
+		ShortURL:    shortLink(rec.ShortURL),
+		OriginalURL: rec.OriginalURL,
+		Variants:    make([]models.VariantStats, len(rec.Variants)),
+	}
+	for i, v := range rec.Variants {
+		stats.Variants[i] = models.VariantStats{URL: v.URL, Weight: v.Weight, Clicks: clicks[i]}
+	}
+	writeJSON(res, http.StatusOK, stats)
+}
+
+func (c *Connection) PostUTMTemplateHandler(res http.ResponseWriter, req *http.Request) {
+	// get json: {"name": "spring", "utm_source": "newsletter", "utm_medium": "email", "utm_campaign": "spring-sale",
+	// "utm_term": "...", "utm_content": "..."}
+	// return json: the saved template
+	user, ok := requireUser(res, req)
+	if !ok {
+		return
+	}
+	var tpl models.UTMTemplate
+	if err := json.NewDecoder(req.Body).Decode(&tpl); err != nil {
+		http.Error(res, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !config.IDRegexp.MatchString(tpl.Name) || len(tpl.Name) > config.MaxShortURLLength {
+		http.Error(res, fmt.Sprintf("Name must be up to %d letters, digits or '-'", config.MaxShortURLLength), http.StatusBadRequest)
+		return
+	}
+	if tpl.Source == "" {
+		http.Error(res, "utm_source is required", http.StatusBadRequest)
+		return
+	}
+	tpl.UserID = user.ID
+	err := c.store.SaveUTMTemplate(req.Context(), tpl)
+	if errors.Is(err, storage.ErrUTMTemplateExists) {
+		http.Error(res, "The template already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(res, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	tpl.UserID = ""
+	writeJSON(res, http.StatusCreated, tpl)
+}
+
+func (c *Connection) GetUTMTemplatesHandler(res http.ResponseWriter, req *http.Request) {
+	// return json: [{"name": "spring", "utm_source": "newsletter", ...}, ...]
+	user, ok := requireUser(res, req)
+	if !ok {
+		return
+	}
+	list, err := c.store.ListUTMTemplates(req.Context(), user.ID)
+	if err != nil {
+		http.Error(res, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	for i := range list {
+		list[i].UserID = ""
+	}
+	writeJSON(res, http.StatusOK, list)
+}
+
+func (c *Connection) PingHandler(res http.ResponseWriter, req *http.Request) {
+	// check the storage (database) is reachable
+	ctx, cancel := context.WithTimeout(req.Context(), pingTimeout)
+	defer cancel()
+	if err := c.store.Ping(ctx); err != nil {
+		http.Error(res, "Storage is unavailable", http.StatusInternalServerError)
+		return
+	}
+	res.WriteHeader(http.StatusOK)
+}
+
 // ------------------------Connection-----------------------------
 
 func checkURL(next http.Handler) http.Handler { // to avoid paths like localhost:8080/{id}/extrapath
@@ -222,12 +1396,25 @@ func checkURL(next http.Handler) http.Handler { // to avoid paths like localhost
 		timeDuration := time.Now() // query duration
 
 		// Handlers
-		if req.Method == http.MethodGet && regexp.MustCompile(`^/[a-zA-Z0-9-]+$`).MatchString(req.URL.Path) {
+		if (req.Method == http.MethodGet || req.Method == http.MethodPost) && config.IDRegexp.MatchString(strings.TrimPrefix(req.URL.Path, "/")) {
+			next.ServeHTTP(logRW, req)
+		} else if (req.Method == http.MethodGet || req.Method == http.MethodPost) && suffixPathRegexp.MatchString(req.URL.Path) &&
+			!strings.HasPrefix(req.URL.Path, "/api/") {
+			next.ServeHTTP(logRW, req) // the handler tells if the link is a passthrough one
+		} else if (req.Method == http.MethodGet || req.Method == http.MethodDelete) && req.URL.Path == "/api/user/urls" {
+			next.ServeHTTP(logRW, req)
+		} else if (req.Method == http.MethodGet || req.Method == http.MethodPost) && req.URL.Path == "/api/utm-templates" {
+			next.ServeHTTP(logRW, req)
+		} else if req.Method == http.MethodPatch && apiURLRegexp.MatchString(req.URL.Path) {
+			next.ServeHTTP(logRW, req)
+		} else if req.Method == http.MethodGet && (apiHistoryRegexp.MatchString(req.URL.Path) || apiStatsRegexp.MatchString(req.URL.Path)) {
 			next.ServeHTTP(logRW, req)
 		} else if req.Method == http.MethodPost && req.URL.Path == "/" {
 			next.ServeHTTP(logRW, req)
 		} else if req.Method == http.MethodPost && req.URL.Path == "/api/shorten" {
 			next.ServeHTTP(logRW, req)
+		} else if req.Method == http.MethodPost && req.URL.Path == "/api/shorten/batch" {
+			next.ServeHTTP(logRW, req)
 		} else {
 			http.Error(res, "Invalid URL", http.StatusBadRequest)
 			logRW.WriteHeader(http.StatusBadRequest)
@@ -245,23 +1432,97 @@ func checkURL(next http.Handler) http.Handler { // to avoid paths like localhost
 }
 
 func LaunchMyRouter(c *Connection) chi.Router {
+	if c.auth == nil {
+		c.auth = auth.New(auth.RandomSecret())
+	}
+	if c.deleter == nil {
+		c.deleter = deleter.New(c.store, deleter.DefaultWorkers, deleter.DefaultBatchSize, deleter.DefaultFlushEvery)
+	}
+	if c.lockout == nil {
+		c.lockout = lockout.New(lockout.DefaultMaxFailures, lockout.DefaultLockFor, nil)
+	}
+	if c.linkLockout == nil {
+		c.linkLockout = lockout.New(lockout.DefaultLinkMaxFailures, lockout.DefaultLockFor, nil)
+	}
 	myRouter := chi.NewRouter()
-	myRouter.Use(checkURL)
+	myRouter.Use(checkURL, c.auth.Middleware)
+	body, batchBody := myRouter.With(limitBody(maxBodySize)), myRouter.With(limitBody(maxBatchBodySize))
+	myRouter.Get("/ping", c.PingHandler)
 	myRouter.Get("/{id}", c.GetHandler)
-	myRouter.Post("/", c.PostHandler)
-	myRouter.Post("/api/shorten", c.PostHandlerJSON)
+	body.Post("/{id}", c.PostPasswordHandler)
+	myRouter.Get("/{id}/*", c.GetHandler) // passthrough links only
+	body.Post("/{id}/*", c.PostPasswordHandler)
+	body.Post("/", c.PostHandler)
+	body.Post("/api/shorten", c.PostHandlerJSON)
+	batchBody.Post("/api/shorten/batch", c.PostHandlerBatch)
+	myRouter.Get("/api/user/urls", c.GetUserURLsHandler)
+	batchBody.Delete("/api/user/urls", c.DeleteUserURLsHandler)
+	body.Patch("/api/urls/{id}", c.PatchURLHandler)
+	myRouter.Get("/api/urls/{id}/history", c.GetHistoryHandler)
+	myRouter.Get("/api/urls/{id}/stats", c.GetStatsHandler)
+	body.Post("/api/utm-templates", c.PostUTMTemplateHandler)
+	myRouter.Get("/api/utm-templates", c.GetUTMTemplatesHandler)
 
 	return myRouter
 }
 
-func main() {
+// newStorage picks the storage backend by the config: database, file or memory
+func newStorage(ctx context.Context) (storage.Storage, error) {
+	if config.DatabaseDSN != "" {
+		return storage.NewDBStorage(ctx, config.DatabaseDSN)
+	}
+	if config.FileStoragePath != "" {
+		return storage.NewFileStorage(config.FileStoragePath)
+	}
+	return storage.NewMemoryStorage(mapURLmain), nil
+}
 
-	c := &Connection{mapURLmain}
+func main() {
 
 	config.ParseFlags() // read a and b flags for host:port and {id} information
 
-	err := http.ListenAndServe(config.HostFlags.String(), LaunchMyRouter(c))
+	store, err := newStorage(context.Background())
 	if err != nil {
 		panic(err)
 	}
+	c := &Connection{
+		store:       store,
+		lockout:     lockout.New(config.PasswordMaxAttempts, config.PasswordLockout, nil),
+		linkLockout: lockout.New(config.PasswordLinkMaxAttempts, config.PasswordLockout, nil),
+	}
+	if config.AuthSecret != "" {
+		c.auth = auth.New([]byte(config.AuthSecret))
+	}
+	if config.GeoIPDatabase != "" {
+		geo, err := geoip.Open(config.GeoIPDatabase)
+		if err != nil {
+			panic(err)
+		}
+		defer geo.Close()
+		c.geo = geo
+	}
+	server := &http.Server{Addr: config.HostFlags.String(), Handler: LaunchMyRouter(c)}
+	cleaner := janitor.Start(c.store, config.JanitorInterval, config.ExpiredRetention, nil)
+	c.health = health.Start(c.store, config.HealthCheckInterval, config.HealthCheckTimeout, config.HealthCheckPrivate)
+
+	// Stop on Ctrl+C: finish the requests, then the queued deletions, then close the storage
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	err = server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		panic(err)
+	}
+	cleaner.Stop()
+	c.health.Stop()
+	c.deleter.Close()
+	if err = c.store.Close(); err != nil {
+		panic(err)
+	}
 }
@@ -3,11 +3,31 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/absurd678/skill/cmd/config"
+	"github.com/absurd678/skill/internal/auth"
+	"github.com/absurd678/skill/internal/deleter"
+	"github.com/absurd678/skill/internal/health"
+	"github.com/absurd678/skill/internal/lockout"
+	"github.com/absurd678/skill/internal/models"
+	"github.com/absurd678/skill/internal/storage"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -16,6 +36,14 @@ type testRequestOptions struct {
 	ts           *httptest.Server
 	method, path string
 	body         io.Reader
+	cookies      []*http.Cookie // optional, e.g. the user cookie
+	header       http.Header    // optional, e.g. User-Agent
+}
+
+// linkPath turns the absolute short URL from a response into the path to GET
+func linkPath(t *testing.T, link string) string {
+	require.True(t, strings.HasPrefix(link, config.BaseURL), "short URL %q must start with %q", link, config.BaseURL)
+	return "/" + strings.TrimPrefix(link, config.BaseURL)
 }
 
 // TestRequest is used instead of Client().Do() when need to check CheckRedirect
@@ -26,6 +54,12 @@ func testRequest(opts testRequestOptions) *http.Response {
 		opts.body,
 	)
 	require.NoError(opts.t, err)
+	for _, cookie := range opts.cookies {
+		req.AddCookie(cookie)
+	}
+	for key, values := range opts.header {
+		req.Header[key] = values
+	}
 	opts.ts.Client().CheckRedirect = func(req *http.Request, via []*http.Request) error {
 		return http.ErrUseLastResponse
 	}
@@ -66,7 +100,7 @@ func Test_GetHandler(t *testing.T) {
 	}
 	for _, tc := range tests {
 		t.Run(tc.Name, func(t *testing.T) {
-			connection := &Connection{tc.MapURL}
+			connection := &Connection{store: storage.NewMemoryStorage(tc.MapURL)}
 			ts := httptest.NewServer(LaunchMyRouter(connection))
 			resp := testRequest(testRequestOptions{
 				t:      t,
@@ -105,7 +139,7 @@ func Test_GzipGetHandler(t *testing.T) {
 	}
 	for _, tc := range tests { // Accept compression
 		t.Run(tc.Name, func(t *testing.T) {
-			connection := &Connection{tc.MapURL}
+			connection := &Connection{store: storage.NewMemoryStorage(tc.MapURL)}
 			ts := httptest.NewServer(LaunchMyRouter(connection))
 
 			req, err := http.NewRequest(
@@ -170,7 +204,7 @@ func Test_PostHandler(t *testing.T) {
 		t.Run(tc.Name, func(t *testing.T) {
 			newBuffer := bytes.NewBuffer([]byte(tc.Body))
 			require.NotEmpty(t, newBuffer) // original URL mustn't be empty
-			testConnect := &Connection{tc.MapURL}
+			testConnect := &Connection{store: storage.NewMemoryStorage(tc.MapURL)}
 			ts := httptest.NewServer(LaunchMyRouter(testConnect))
 			resp := testRequest(testRequestOptions{
 				t:      t,
@@ -184,6 +218,51 @@ func Test_PostHandler(t *testing.T) {
 	}
 }
 
+func Test_RequestLimits(t *testing.T) {
+	ts := httptest.NewServer(LaunchMyRouter(&Connection{store: storage.NewMemoryStorage(nil)}))
+	defer ts.Close()
+	longURL := "https://long.ru/" + strings.Repeat("x", maxURLLength)
+	rules := strings.TrimSuffix(strings.Repeat(`{"os": "ios", "url": "https://x.ru/ios"},`, maxDeviceRules+1), ",")
+
+	for _, tc := range []struct {
+		Name     string
+		Path     string
+		Body     string
+		WantCode int
+	}{
+		{Name: "Huge body", Path: "/", Body: strings.Repeat("x", 2<<20), WantCode: http.StatusBadRequest},
+		{Name: "Long URL", Path: "/", Body: longURL, WantCode: http.StatusBadRequest},
+		{Name: "Long URL in JSON", Path: "/api/shorten", Body: `{"url": "` + longURL + `"}`, WantCode: http.StatusBadRequest},
+		{Name: "Long rule URL", Path: "/api/shorten",
+			Body: `{"url": "https://x.ru", "device_rules": [{"os": "ios", "url": "` + longURL + `"}]}`, WantCode: http.StatusBadRequest},
+		{Name: "Too many rules", Path: "/api/shorten", Body: `{"url": "https://x.ru", "device_rules": [` + rules + `]}`,
+			WantCode: http.StatusBadRequest},
+		{Name: "Huge JSON", Path: "/api/shorten", Body: `{"url": "https://x.ru", "alias": "` + strings.Repeat("x", 2<<20) + `"}`,
+			WantCode: http.StatusBadRequest},
+		{Name: "Long batch URL", Path: "/api/shorten/batch", Body: `[{"correlation_id": "1", "original_url": "` + longURL + `"}]`,
+			WantCode: http.StatusBadRequest},
+		{Name: "OK", Path: "/api/shorten", Body: `{"url": "https://x.ru/` + strings.Repeat("x", 1000) + `"}`, WantCode: http.StatusCreated},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: tc.Path,
+				body: strings.NewReader(tc.Body)})
+			resp.Body.Close()
+			require.Equal(t, tc.WantCode, resp.StatusCode)
+		})
+	}
+
+	// the limit is on the decompressed body
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(strings.Repeat("x", 2<<20)))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/", body: &buf,
+		header: http.Header{"Content-Encoding": {"gzip"}}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
 // TESTING THE COMPRESSION
 
 func Test_GzipPostHandler(t *testing.T) {
@@ -213,7 +292,7 @@ func Test_GzipPostHandler(t *testing.T) {
 			var bodyResp []byte
 			newBuffer := bytes.NewBuffer([]byte(tc.Body))
 			require.NotEmpty(t, newBuffer) // original URL mustn't be empty
-			testConnect := &Connection{tc.MapURL}
+			testConnect := &Connection{store: storage.NewMemoryStorage(tc.MapURL)}
 
 			// Set request params
 			ts := httptest.NewServer(LaunchMyRouter(testConnect))
@@ -262,7 +341,7 @@ func Test_GzipPostHandler(t *testing.T) {
 			require.NoError(t, err)
 
 			// set request params
-			testConnect := &Connection{tc.MapURL}
+			testConnect := &Connection{store: storage.NewMemoryStorage(tc.MapURL)}
 			ts := httptest.NewServer(LaunchMyRouter(testConnect))
 			req, err := http.NewRequest(
 				tc.Method,
@@ -328,7 +407,7 @@ func TestPostHandlerJSON(t *testing.T) {
 
 	for _, tc := range testBlock {
 		t.Run(tc.Name, func(t *testing.T) {
-			newConnect := &Connection{mapURL: tc.MapURL} // connect having optional map
+			newConnect := &Connection{store: storage.NewMemoryStorage(tc.MapURL)} // connect having optional map
 			newBody := bytes.NewBuffer([]byte(tc.Body))
 			require.NotEmpty(t, newBody) // body must json, not empty
 
@@ -374,7 +453,7 @@ func Test_GzipPostHandlerJSON(t *testing.T) {
 
 			newBuffer := bytes.NewBuffer([]byte(tc.Body))
 			require.NotEmpty(t, newBuffer) // original URL mustn't be empty
-			testConnect := &Connection{tc.MapURL}
+			testConnect := &Connection{store: storage.NewMemoryStorage(tc.MapURL)}
 
 			// set request parameters
 			ts := httptest.NewServer(LaunchMyRouter(testConnect))
@@ -423,7 +502,7 @@ func Test_GzipPostHandlerJSON(t *testing.T) {
 			require.NoError(t, err)
 
 			// Set a request
-			testConnect := &Connection{tc.MapURL}
+			testConnect := &Connection{store: storage.NewMemoryStorage(tc.MapURL)}
 			ts := httptest.NewServer(LaunchMyRouter(testConnect))
 			req, err := http.NewRequest(
 				tc.Method,
@@ -442,3 +521,1657 @@ func Test_GzipPostHandlerJSON(t *testing.T) {
 		})
 	}
 }
+
+// collideStorage reports a collision for the first `collisions` saves
+type collideStorage struct {
+	storage.Storage
+	collisions int
+}
+
+func (s *collideStorage) Save(ctx context.Context, rec models.URLRecord) error {
+	if s.collisions > 0 {
+		s.collisions--
+		return storage.ErrShortURLExists
+	}
+	return s.Storage.Save(ctx, rec)
+}
+
+// Test the id generation
+func Test_saveNewURL(t *testing.T) {
+	tests := []struct {
+		Name       string
+		Collisions int
+		WantErr    bool
+	}{
+		{Name: "No collisions", Collisions: 0},
+		{Name: "Retry after collisions", Collisions: maxIDAttempts - 1},
+		{Name: "Out of attempts", Collisions: maxIDAttempts, WantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			st := &collideStorage{Storage: storage.NewMemoryStorage(nil), collisions: tc.Collisions}
+			c := &Connection{store: st}
+			shortURL, err := c.saveNewURL(context.Background(), models.URLRecord{OriginalURL: "https://practicum.net"})
+			if tc.WantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, shortURL, config.ShortURLLength)
+			rec, err := st.Get(context.Background(), shortURL)
+			require.NoError(t, err)
+			require.Equal(t, "https://practicum.net", rec.OriginalURL)
+		})
+	}
+}
+
+// Every POST must get its own id
+func Test_PostHandlerUniqueIDs(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil)}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+
+	ids := map[string]string{}
+	for _, original := range []string{"https://practicum.net", "https://mai.ru", "https://ya.ru"} {
+		resp := testRequest(testRequestOptions{
+			t:      t,
+			ts:     ts,
+			method: http.MethodPost,
+			path:   "/",
+			body:   bytes.NewBufferString(original),
+		})
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		require.NotContains(t, ids, string(body))
+		ids[string(body)] = original
+	}
+
+	// and every id leads to its own original URL
+	for link, original := range ids {
+		resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: linkPath(t, link)})
+		resp.Body.Close()
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		require.Equal(t, original, resp.Header.Get("Location"))
+	}
+}
+
+// Run with -race: parallel POST and GET traffic through the whole router
+func Test_ParallelPostGet(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil)}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+	ts.Client().CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	const workers, perWorker = 8, 25
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				original := fmt.Sprintf("https://example.com/%d/%d", w, i)
+				resp, err := ts.Client().Post(ts.URL+"/", "text/plain", bytes.NewBufferString(original))
+				if !assert.NoError(t, err) {
+					return
+				}
+				link, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusCreated, resp.StatusCode)
+				if !assert.True(t, strings.HasPrefix(string(link), config.BaseURL)) {
+					return
+				}
+
+				resp, err = ts.Client().Get(ts.URL + "/" + strings.TrimPrefix(string(link), config.BaseURL))
+				if !assert.NoError(t, err) {
+					return
+				}
+				resp.Body.Close()
+				assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+				assert.Equal(t, original, resp.Header.Get("Location"))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	list, err := testConnect.store.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, list, workers*perWorker)
+}
+
+// pingErrStorage is a storage whose backend is down
+type pingErrStorage struct {
+	storage.Storage
+}
+
+func (s *pingErrStorage) Ping(context.Context) error {
+	return errors.New("connection refused")
+}
+
+// Test the ping handler
+func Test_PingHandler(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Store    storage.Storage
+		WantCode int
+	}{
+		{
+			Name:     "OK",
+			Store:    storage.NewMemoryStorage(nil),
+			WantCode: http.StatusOK,
+		},
+		{
+			Name:     "Storage is down",
+			Store:    &pingErrStorage{storage.NewMemoryStorage(nil)},
+			WantCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			ts := httptest.NewServer(LaunchMyRouter(&Connection{store: tc.Store}))
+			defer ts.Close()
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/ping"})
+			resp.Body.Close()
+			require.Equal(t, tc.WantCode, resp.StatusCode)
+		})
+	}
+}
+
+// Test the batch handler
+func Test_PostHandlerBatch(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Body     string
+		WantCode int
+		WantIDs  []string // correlation ids in the answer
+	}{
+		{
+			Name:     "OK",
+			Body:     `[{"correlation_id": "1", "original_url": "https://mai.ru"}, {"correlation_id": "2", "original_url": "https://practicum.net"}]`,
+			WantCode: http.StatusCreated,
+			WantIDs:  []string{"1", "2"},
+		},
+		{
+			Name:     "Empty batch",
+			Body:     `[]`,
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "No original URL",
+			Body:     `[{"correlation_id": "1"}]`,
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "Not an array",
+			Body:     `{"correlation_id": "1", "original_url": "https://mai.ru"}`,
+			WantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			testConnect := &Connection{store: storage.NewMemoryStorage(nil)}
+			ts := httptest.NewServer(LaunchMyRouter(testConnect))
+			defer ts.Close()
+			resp := testRequest(testRequestOptions{
+				t:      t,
+				ts:     ts,
+				method: http.MethodPost,
+				path:   "/api/shorten/batch",
+				body:   bytes.NewBufferString(tc.Body),
+			})
+			defer resp.Body.Close()
+			require.Equal(t, tc.WantCode, resp.StatusCode)
+			if tc.WantCode != http.StatusCreated {
+				return
+			}
+
+			var result []models.BatchResponseItem
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+			require.Len(t, result, len(tc.WantIDs))
+			for i, item := range result {
+				require.Equal(t, tc.WantIDs[i], item.CorrelationID)
+				rec, err := testConnect.store.Get(context.Background(), strings.TrimPrefix(linkPath(t, item.ShortURL), "/"))
+				require.NoError(t, err)
+				require.NotEmpty(t, rec.OriginalURL)
+			}
+		})
+	}
+}
+
+// The same original URL twice gives 409 with the existing short URL
+func Test_PostDuplicate(t *testing.T) {
+	tests := []struct {
+		Name string
+		Path string
+		Body string
+	}{
+		{
+			Name: "Plain text",
+			Path: "/",
+			Body: "https://practicum.net",
+		},
+		{
+			Name: "JSON",
+			Path: "/api/shorten",
+			Body: `{"url": "https://practicum.net"}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			testConnect := &Connection{store: storage.NewMemoryStorage(nil)}
+			ts := httptest.NewServer(LaunchMyRouter(testConnect))
+			defer ts.Close()
+
+			var bodies []string
+			for _, wantCode := range []int{http.StatusCreated, http.StatusConflict} {
+				resp := testRequest(testRequestOptions{
+					t:      t,
+					ts:     ts,
+					method: http.MethodPost,
+					path:   tc.Path,
+					body:   bytes.NewBufferString(tc.Body),
+				})
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				resp.Body.Close()
+				require.Equal(t, wantCode, resp.StatusCode)
+				bodies = append(bodies, string(body))
+			}
+			require.Equal(t, bodies[0], bodies[1]) // the same short URL
+
+			list, err := testConnect.store.List(context.Background())
+			require.NoError(t, err)
+			require.Len(t, list, 1)
+		})
+	}
+}
+
+// The creation endpoints answer with absolute short URLs on the base URL
+func Test_PostAbsoluteShortURL(t *testing.T) {
+	oldBaseURL := config.BaseURL
+	config.BaseURL = "https://s.example.com/"
+	defer func() { config.BaseURL = oldBaseURL }()
+
+	tests := []struct {
+		Name   string
+		Path   string
+		Body   string
+		Result func(body []byte) string // takes the short URL out of the body
+	}{
+		{
+			Name:   "Plain text",
+			Path:   "/",
+			Body:   "https://practicum.net",
+			Result: func(body []byte) string { return string(body) },
+		},
+		{
+			Name: "JSON",
+			Path: "/api/shorten",
+			Body: `{"url": "https://practicum.net"}`,
+			Result: func(body []byte) string {
+				var short models.ShortURL
+				require.NoError(t, json.Unmarshal(body, &short))
+				return short.URL
+			},
+		},
+		{
+			Name: "Batch",
+			Path: "/api/shorten/batch",
+			Body: `[{"correlation_id": "1", "original_url": "https://practicum.net"}]`,
+			Result: func(body []byte) string {
+				var batch []models.BatchResponseItem
+				require.NoError(t, json.Unmarshal(body, &batch))
+				require.Len(t, batch, 1)
+				return batch[0].ShortURL
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			ts := httptest.NewServer(LaunchMyRouter(&Connection{store: storage.NewMemoryStorage(nil)}))
+			defer ts.Close()
+			resp := testRequest(testRequestOptions{
+				t:      t,
+				ts:     ts,
+				method: http.MethodPost,
+				path:   tc.Path,
+				body:   bytes.NewBufferString(tc.Body),
+			})
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+			short := tc.Result(body)
+			require.True(t, strings.HasPrefix(short, "https://s.example.com/"), short)
+			require.Len(t, strings.TrimPrefix(short, "https://s.example.com/"), config.ShortURLLength)
+		})
+	}
+}
+
+// The links are stored with the owner from the cookie
+func Test_PostOwner(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil), auth: auth.New([]byte("secret"))}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+
+	// the first request gets a cookie
+	resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/", body: bytes.NewBufferString("https://mai.ru")})
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	cookies := resp.Cookies()
+	require.Len(t, cookies, 1)
+	userID, ok := testConnect.auth.Verify(cookies[0].Value)
+	require.True(t, ok)
+
+	// the next one sends it back
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/shorten", bytes.NewBufferString(`{"url": "https://practicum.net"}`))
+	require.NoError(t, err)
+	req.AddCookie(cookies[0])
+	resp, err = ts.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Empty(t, resp.Cookies())
+
+	list, err := testConnect.store.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	for _, rec := range list {
+		require.Equal(t, userID, rec.UserID)
+	}
+}
+
+// userCookie makes a valid cookie of the user
+func userCookie(c *Connection, userID string) *http.Cookie {
+	return &http.Cookie{Name: auth.CookieName, Value: c.auth.Sign(userID)}
+}
+
+// Test the user links handler
+func Test_GetUserURLsHandler(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil), auth: auth.New([]byte("secret"))}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+	ctx := context.Background()
+	for i, original := range []string{"https://a.ru", "https://b.ru", "https://c.ru"} {
+		require.NoError(t, testConnect.store.Save(ctx, models.URLRecord{
+			ShortURL:    fmt.Sprintf("id%d", i),
+			OriginalURL: original,
+			UserID:      "user-1",
+		}))
+	}
+
+	tests := []struct {
+		Name       string
+		Cookies    []*http.Cookie
+		Query      string
+		WantCode   int
+		WantURLs   []string // original URLs
+		WantCursor bool
+	}{
+		{
+			Name:     "No cookie",
+			WantCode: http.StatusUnauthorized,
+		},
+		{
+			Name:     "Forged cookie",
+			Cookies:  []*http.Cookie{{Name: auth.CookieName, Value: "user-1.forged"}},
+			WantCode: http.StatusUnauthorized,
+		},
+		{
+			Name:     "No links",
+			Cookies:  []*http.Cookie{userCookie(testConnect, "user-2")},
+			WantCode: http.StatusNoContent,
+		},
+		{
+			Name:     "All links",
+			Cookies:  []*http.Cookie{userCookie(testConnect, "user-1")},
+			WantCode: http.StatusOK,
+			WantURLs: []string{"https://a.ru", "https://b.ru", "https://c.ru"},
+		},
+		{
+			Name:       "First page",
+			Cookies:    []*http.Cookie{userCookie(testConnect, "user-1")},
+			Query:      "?limit=2",
+			WantCode:   http.StatusOK,
+			WantURLs:   []string{"https://a.ru", "https://b.ru"},
+			WantCursor: true,
+		},
+		{
+			Name:     "Bad limit",
+			Cookies:  []*http.Cookie{userCookie(testConnect, "user-1")},
+			Query:    "?limit=-1",
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "Bad cursor",
+			Cookies:  []*http.Cookie{userCookie(testConnect, "user-1")},
+			Query:    "?cursor=not*base64",
+			WantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/api/user/urls" + tc.Query, cookies: tc.Cookies})
+			defer resp.Body.Close()
+			require.Equal(t, tc.WantCode, resp.StatusCode)
+			require.Equal(t, tc.WantCursor, resp.Header.Get(nextCursorHeader) != "")
+			if tc.WantCode != http.StatusOK {
+				return
+			}
+			var result []models.UserURL
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+			require.Len(t, result, len(tc.WantURLs))
+			for i, u := range result {
+				require.Equal(t, tc.WantURLs[i], u.OriginalURL)
+				require.True(t, strings.HasPrefix(u.ShortURL, config.BaseURL))
+			}
+		})
+	}
+
+	// the cursor leads to the next page
+	first := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/api/user/urls?limit=2",
+		cookies: []*http.Cookie{userCookie(testConnect, "user-1")}})
+	first.Body.Close()
+	resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet,
+		path:    "/api/user/urls?limit=2&cursor=" + first.Header.Get(nextCursorHeader),
+		cookies: []*http.Cookie{userCookie(testConnect, "user-1")}})
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get(nextCursorHeader))
+	var result []models.UserURL
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	require.Len(t, result, 1)
+	require.Equal(t, "https://c.ru", result[0].OriginalURL)
+}
+
+// Test the bulk deletion
+func Test_DeleteUserURLsHandler(t *testing.T) {
+	store := storage.NewMemoryStorage(nil)
+	testConnect := &Connection{
+		store:   store,
+		auth:    auth.New([]byte("secret")),
+		deleter: deleter.New(store, 1, deleter.DefaultBatchSize, 10*time.Millisecond),
+	}
+	defer testConnect.deleter.Close()
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+	ctx := context.Background()
+	require.NoError(t, store.Save(ctx, models.URLRecord{ShortURL: "mine", OriginalURL: "https://a.ru", UserID: "user-1"}))
+	require.NoError(t, store.Save(ctx, models.URLRecord{ShortURL: "theirs", OriginalURL: "https://b.ru", UserID: "user-2"}))
+
+	tests := []struct {
+		Name     string
+		Cookies  []*http.Cookie
+		Body     string
+		WantCode int
+	}{
+		{
+			Name:     "No cookie",
+			Body:     `["mine"]`,
+			WantCode: http.StatusUnauthorized,
+		},
+		{
+			Name:     "Not JSON array",
+			Cookies:  []*http.Cookie{userCookie(testConnect, "user-1")},
+			Body:     `{"id": "mine"}`,
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "Invalid id",
+			Cookies:  []*http.Cookie{userCookie(testConnect, "user-1")},
+			Body:     `["../mine"]`,
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "Accepted",
+			Cookies:  []*http.Cookie{userCookie(testConnect, "user-1")},
+			Body:     `["mine", "theirs"]`,
+			WantCode: http.StatusAccepted,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodDelete, path: "/api/user/urls",
+				body: bytes.NewBufferString(tc.Body), cookies: tc.Cookies})
+			resp.Body.Close()
+			require.Equal(t, tc.WantCode, resp.StatusCode)
+		})
+	}
+
+	// own link is gone soon, the other user's link still works
+	require.Eventually(t, func() bool {
+		resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/mine"})
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusGone
+	}, time.Second, 10*time.Millisecond)
+	resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/theirs"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+}
+
+// Test changing the destination and its history
+func Test_PatchURLHandler(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil), auth: auth.New([]byte("secret"))}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+	ctx := context.Background()
+	require.NoError(t, testConnect.store.Save(ctx, models.URLRecord{ShortURL: "mine", OriginalURL: "https://typo.ru", UserID: "user-1"}))
+	require.NoError(t, testConnect.store.Save(ctx, models.URLRecord{ShortURL: "other", OriginalURL: "https://b.ru", UserID: "user-1"}))
+	require.NoError(t, testConnect.store.Save(ctx, models.URLRecord{ShortURL: "gone", OriginalURL: "https://c.ru", UserID: "user-1", DeletedFlag: true}))
+	owner := []*http.Cookie{userCookie(testConnect, "user-1")}
+
+	tests := []struct {
+		Name     string
+		Cookies  []*http.Cookie
+		Path     string
+		Body     string
+		WantCode int
+	}{
+		{Name: "No cookie", Path: "/api/urls/mine", Body: `{"url": "https://a.ru"}`, WantCode: http.StatusUnauthorized},
+		{Name: "Not owner", Cookies: []*http.Cookie{userCookie(testConnect, "user-2")}, Path: "/api/urls/mine", Body: `{"url": "https://a.ru"}`, WantCode: http.StatusForbidden},
+		{Name: "Unknown id", Cookies: owner, Path: "/api/urls/nothing", Body: `{"url": "https://a.ru"}`, WantCode: http.StatusNotFound},
+		{Name: "Deleted", Cookies: owner, Path: "/api/urls/gone", Body: `{"url": "https://a.ru"}`, WantCode: http.StatusGone},
+		{Name: "Empty URL", Cookies: owner, Path: "/api/urls/mine", Body: `{"url": ""}`, WantCode: http.StatusBadRequest},
+		{Name: "Taken URL", Cookies: owner, Path: "/api/urls/mine", Body: `{"url": "https://b.ru"}`, WantCode: http.StatusConflict},
+		{Name: "OK", Cookies: owner, Path: "/api/urls/mine", Body: `{"url": "https://a.ru"}`, WantCode: http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPatch, path: tc.Path,
+				body: bytes.NewBufferString(tc.Body), cookies: tc.Cookies})
+			resp.Body.Close()
+			require.Equal(t, tc.WantCode, resp.StatusCode)
+		})
+	}
+
+	// the link leads to the new destination
+	resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/mine"})
+	resp.Body.Close()
+	require.Equal(t, "https://a.ru", resp.Header.Get("Location"))
+
+	// and remembers the old one
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/api/urls/mine/history", cookies: owner})
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var history models.URLHistory
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&history))
+	require.Equal(t, config.BaseURL+"mine", history.ShortURL)
+	require.Equal(t, "https://a.ru", history.OriginalURL)
+	require.Len(t, history.History, 1)
+	require.Equal(t, "https://typo.ru", history.History[0].OriginalURL)
+
+	// the history is for the owner only
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/api/urls/mine/history",
+		cookies: []*http.Cookie{userCookie(testConnect, "user-2")}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+// Test the custom aliases
+func Test_PostHandlerJSONAlias(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(map[string]string{"taken": "https://mai.ru"})}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+
+	tests := []struct {
+		Name       string
+		Body       string
+		WantCode   int
+		WantResult string
+	}{
+		{
+			Name:       "OK",
+			Body:       `{"url": "https://shop.ru/sale", "alias": "spring-sale"}`,
+			WantCode:   http.StatusCreated,
+			WantResult: config.BaseURL + "spring-sale",
+		},
+		{
+			Name:     "Taken",
+			Body:     `{"url": "https://shop.ru/other", "alias": "taken"}`,
+			WantCode: http.StatusConflict,
+		},
+		{
+			Name:     "Reserved",
+			Body:     `{"url": "https://shop.ru/other", "alias": "API"}`,
+			WantCode: http.StatusConflict,
+		},
+		{
+			Name:     "Invalid characters",
+			Body:     `{"url": "https://shop.ru/other", "alias": "spring/sale"}`,
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "Too long",
+			Body:     `{"url": "https://shop.ru/other", "alias": "` + strings.Repeat("a", config.MaxShortURLLength+1) + `"}`,
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:       "Already shortened URL",
+			Body:       `{"url": "https://mai.ru", "alias": "mai"}`,
+			WantCode:   http.StatusConflict,
+			WantResult: config.BaseURL + "taken",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+				body: bytes.NewBufferString(tc.Body)})
+			defer resp.Body.Close()
+			require.Equal(t, tc.WantCode, resp.StatusCode)
+			if tc.WantResult == "" {
+				return
+			}
+			var short models.ShortURL
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&short))
+			require.Equal(t, tc.WantResult, short.URL)
+		})
+	}
+
+	resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/spring-sale"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	require.Equal(t, "https://shop.ru/sale", resp.Header.Get("Location"))
+}
+
+// Test the links with ttl and expires_at
+func Test_PostHandlerJSONExpiry(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil)}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		Name     string
+		Body     string
+		WantCode int
+	}{
+		{Name: "TTL", Body: `{"url": "https://a.ru", "alias": "ttl", "ttl": 3600}`, WantCode: http.StatusCreated},
+		{Name: "Expires at", Body: `{"url": "https://b.ru", "alias": "at", "expires_at": "` + future + `"}`, WantCode: http.StatusCreated},
+		{Name: "Both", Body: `{"url": "https://c.ru", "ttl": 60, "expires_at": "` + future + `"}`, WantCode: http.StatusBadRequest},
+		{Name: "Negative TTL", Body: `{"url": "https://c.ru", "ttl": -1}`, WantCode: http.StatusBadRequest},
+		{Name: "Overflowing TTL", Body: `{"url": "https://c.ru", "ttl": 9300000000}`, WantCode: http.StatusBadRequest},
+		{Name: "Longest TTL", Body: `{"url": "https://d.ru", "ttl": ` + strconv.FormatInt(maxTTL, 10) + `}`, WantCode: http.StatusCreated},
+		{Name: "In the past", Body: `{"url": "https://c.ru", "expires_at": "` + past + `"}`, WantCode: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+				body: bytes.NewBufferString(tc.Body)})
+			resp.Body.Close()
+			require.Equal(t, tc.WantCode, resp.StatusCode)
+		})
+	}
+
+	rec, err := testConnect.store.Get(context.Background(), "ttl")
+	require.NoError(t, err)
+	require.NotNil(t, rec.ExpiresAt)
+	require.WithinDuration(t, time.Now().Add(time.Hour), *rec.ExpiresAt, time.Minute)
+
+	// a live link redirects, an expired one is gone
+	resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/at"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+
+	expired := time.Now().Add(-time.Second)
+	require.NoError(t, testConnect.store.Save(context.Background(),
+		models.URLRecord{ShortURL: "old", OriginalURL: "https://old.ru", ExpiresAt: &expired}))
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/old"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+
+	// the URL of an expired link can be shortened again without waiting for the janitor
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/", body: bytes.NewBufferString("https://old.ru")})
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// the expired id is still gone and can't be taken till the janitor purges it
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/old"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+		body: bytes.NewBufferString(`{"url": "https://phishing.ru", "alias": "old"}`)})
+	resp.Body.Close()
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func Test_PostHandlerJSONMaxClicks(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil)}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+
+	tests := []struct {
+		Name     string
+		Body     string
+		WantCode int
+	}{
+		{Name: "One-time", Body: `{"url": "https://once.ru", "alias": "once", "max_clicks": 1}`, WantCode: http.StatusCreated},
+		{Name: "Limited", Body: `{"url": "https://few.ru", "alias": "few", "max_clicks": 20}`, WantCode: http.StatusCreated},
+		{Name: "Negative", Body: `{"url": "https://c.ru", "max_clicks": -1}`, WantCode: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+				body: bytes.NewBufferString(tc.Body)})
+			resp.Body.Close()
+			require.Equal(t, tc.WantCode, resp.StatusCode)
+		})
+	}
+
+	// a one-time link redirects once and is gone afterwards
+	resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/once"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	require.Equal(t, "https://once.ru", resp.Header.Get("Location"))
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/once"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+
+	// parallel redirects never spend more clicks than there are
+	const clickers = 100
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	codes := map[int]int{}
+	for i := 0; i < clickers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := ts.Client().Get(ts.URL + "/few")
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp.Body.Close()
+			mu.Lock()
+			codes[resp.StatusCode]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, map[int]int{http.StatusTemporaryRedirect: 20, http.StatusGone: clickers - 20}, codes)
+
+	// the URL of a used up link can be shortened again, by anybody and many times at once:
+	// one gets a new link, the rest get it as a conflict
+	const posters = 10
+	codes = map[int]int{}
+	for i := 0; i < posters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := ts.Client().Post(ts.URL+"/", "text/plain", bytes.NewBufferString("https://once.ru"))
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp.Body.Close()
+			mu.Lock()
+			codes[resp.StatusCode]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, map[int]int{http.StatusCreated: 1, http.StatusConflict: posters - 1}, codes)
+
+	// the used up link has only given its URL away
+	rec, err := testConnect.store.Get(context.Background(), "once")
+	require.NoError(t, err)
+	require.True(t, rec.Released)
+	require.False(t, rec.DeletedFlag)
+
+	// another user shortening the URL of a used up link leaves the link to its owner
+	owner := []*http.Cookie{userCookie(testConnect, "owner")}
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten", cookies: owner,
+		body: bytes.NewBufferString(`{"url": "https://gift.ru", "alias": "gift", "max_clicks": 1}`)})
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/gift"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/", cookies: []*http.Cookie{userCookie(testConnect, "other")},
+		body: bytes.NewBufferString("https://gift.ru")})
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	for _, path := range []string{"/api/urls/gift/history", "/api/urls/gift/stats", "/api/user/urls"} {
+		resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: path, cookies: owner})
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode, path)
+		require.Contains(t, string(body), "gift", path)
+	}
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/gift"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func Test_PasswordProtectedLink(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil), lockout: lockout.New(3, time.Minute, nil)}
+	router := LaunchMyRouter(testConnect)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	tests := []struct {
+		Name     string
+		Body     string
+		WantCode int
+	}{
+		{Name: "Protected", Body: `{"url": "https://secret.ru", "alias": "secret", "password": "open sesame", "max_clicks": 2}`, WantCode: http.StatusCreated},
+		{Name: "Public", Body: `{"url": "https://public.ru", "alias": "public"}`, WantCode: http.StatusCreated},
+		{Name: "Too long", Body: `{"url": "https://c.ru", "password": "` + strings.Repeat("x", maxPasswordLength+1) + `"}`, WantCode: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+				body: bytes.NewBufferString(tc.Body)})
+			resp.Body.Close()
+			require.Equal(t, tc.WantCode, resp.StatusCode)
+		})
+	}
+
+	// only the hash is kept
+	rec, err := testConnect.store.Get(context.Background(), "secret")
+	require.NoError(t, err)
+	require.NotEmpty(t, rec.PasswordHash)
+	require.NotContains(t, rec.PasswordHash, "open sesame")
+
+	// the form instead of the redirect
+	resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/secret"})
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+	require.Contains(t, string(page), `<form method="post">`)
+	require.Empty(t, resp.Header.Get("Location"))
+
+	// the lockout is per client address, so the form is posted straight to the router
+	postPassword := func(path, password, addr string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader("password="+password))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = addr
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Result()
+	}
+
+	// the public link has nothing to check
+	resp = postPassword("/public", "x", "10.0.0.1:1000")
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// a wrong password shows the form again, the right one redirects with GET
+	resp = postPassword("/secret", "wrong", "10.0.0.1:1000")
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = postPassword("/secret", "open+sesame", "10.0.0.1:1000")
+	resp.Body.Close()
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	require.Equal(t, "https://secret.ru", resp.Header.Get("Location"))
+
+	// three wrong passwords in a row lock the client out, even with the right one
+	for i := 0; i < 2; i++ {
+		resp = postPassword("/secret", "wrong", "10.0.0.1:1000")
+		resp.Body.Close()
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+	resp = postPassword("/secret", "wrong", "10.0.0.1:2000")
+	resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "60", resp.Header.Get("Retry-After"))
+	resp = postPassword("/secret", "open+sesame", "10.0.0.1:1000")
+	resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// other clients are not locked out, the click limit still counts
+	resp = postPassword("/secret", "open+sesame", "10.0.0.2:1000")
+	resp.Body.Close()
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	resp = postPassword("/secret", "open+sesame", "10.0.0.2:1000")
+	resp.Body.Close()
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func Test_PasswordLockoutKeys(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil),
+		lockout: lockout.New(2, time.Minute, nil), linkLockout: lockout.New(4, time.Minute, nil)}
+	router := LaunchMyRouter(testConnect)
+	for _, body := range []string{
+		`{"url": "https://v6.ru", "alias": "v6", "password": "open sesame"}`,
+		`{"url": "https://many.ru", "alias": "many", "password": "open sesame"}`,
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body)))
+		require.Equal(t, http.StatusCreated, rr.Code, body)
+	}
+	postPassword := func(path, password, addr string) int {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader("password="+password))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = addr
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// the addresses of one IPv6 /64 are one client
+	require.Equal(t, http.StatusForbidden, postPassword("/v6", "wrong", "[2001:db8:0:1::1]:1000"))
+	require.Equal(t, http.StatusTooManyRequests, postPassword("/v6", "wrong", "[2001:db8:0:1::2]:1000"))
+	require.Equal(t, http.StatusTooManyRequests, postPassword("/v6", "open+sesame", "[2001:db8:0:1:ffff::3]:1000"))
+	require.Equal(t, http.StatusSeeOther, postPassword("/v6", "open+sesame", "[2001:db8:0:2::1]:1000"))
+
+	// every address guesses once, together they use up the budget of the link
+	for i := 1; i < 4; i++ {
+		require.Equal(t, http.StatusForbidden, postPassword("/many", "wrong", fmt.Sprintf("10.0.0.%d:1000", i)))
+	}
+	require.Equal(t, http.StatusTooManyRequests, postPassword("/many", "wrong", "10.0.0.4:1000"))
+	require.Equal(t, http.StatusTooManyRequests, postPassword("/many", "open+sesame", "10.0.0.5:1000"))
+	// the other links are not affected
+	require.Equal(t, http.StatusSeeOther, postPassword("/v6", "open+sesame", "10.0.0.5:1000"))
+
+	// the typos of the visitors who know the password don't lock the link
+	for i := 1; i <= 10; i++ {
+		addr := fmt.Sprintf("10.0.1.%d:1000", i)
+		require.Equal(t, http.StatusForbidden, postPassword("/v6", "typo", addr))
+		require.Equal(t, http.StatusSeeOther, postPassword("/v6", "open+sesame", addr))
+	}
+}
+
+func Test_RedirectType(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil)}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+	visitor := userCookie(testConnect, "visitor") // a returning one, nothing to set
+	oldType, oldMaxAge := config.RedirectType, config.PermanentRedirectMaxAge
+	defer func() { config.RedirectType, config.PermanentRedirectMaxAge = oldType, oldMaxAge }()
+	config.RedirectType, config.PermanentRedirectMaxAge = http.StatusFound, time.Hour
+
+	for _, body := range []string{
+		`{"url": "https://default.ru", "alias": "default"}`,
+		`{"url": "https://moved.ru", "alias": "moved", "redirect_type": 301}`,
+		`{"url": "https://permanent.ru", "alias": "permanent", "redirect_type": 308}`,
+		`{"url": "https://temporary.ru", "alias": "temporary", "redirect_type": 307}`,
+		`{"url": "https://soon.ru", "alias": "soon", "redirect_type": 301, "ttl": 60}`,
+		`{"url": "https://counted.ru", "alias": "counted", "redirect_type": 308, "max_clicks": 10}`,
+	} {
+		resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+			body: bytes.NewBufferString(body)})
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode, body)
+	}
+	resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+		body: bytes.NewBufferString(`{"url": "https://other.ru", "redirect_type": 303}`)})
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	tests := []struct {
+		Name         string
+		Path         string
+		WantCode     int
+		WantCacheCtl string // regexp
+	}{
+		{Name: "Server default", Path: "/default", WantCode: http.StatusFound, WantCacheCtl: "no-store"},
+		{Name: "Moved permanently", Path: "/moved", WantCode: http.StatusMovedPermanently, WantCacheCtl: "public, max-age=3600"},
+		{Name: "Permanent redirect", Path: "/permanent", WantCode: http.StatusPermanentRedirect, WantCacheCtl: "public, max-age=3600"},
+		{Name: "Temporary redirect", Path: "/temporary", WantCode: http.StatusTemporaryRedirect, WantCacheCtl: "no-store"},
+		{Name: "Expires sooner", Path: "/soon", WantCode: http.StatusMovedPermanently, WantCacheCtl: "public, max-age=(59|60)"}, // a second may have passed
+		{Name: "Click-limited", Path: "/counted", WantCode: http.StatusPermanentRedirect, WantCacheCtl: "no-store"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: tc.Path,
+				cookies: []*http.Cookie{visitor}})
+			resp.Body.Close()
+			require.Equal(t, tc.WantCode, resp.StatusCode)
+			require.Equal(t, "https:/"+tc.Path+".ru", resp.Header.Get("Location"))
+			require.Regexp(t, "^"+tc.WantCacheCtl+"$", resp.Header.Get("Cache-Control"))
+			if strings.HasPrefix(resp.Header.Get("Cache-Control"), "public") {
+				require.Empty(t, resp.Header.Values("Set-Cookie"), "a shared cache would give the cookie to everybody")
+			}
+		})
+	}
+
+	// a new visitor gets the user cookie, so the redirect is cached by their client only
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/moved"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Values("Set-Cookie"))
+	require.Equal(t, "private, max-age=3600", resp.Header.Get("Cache-Control"))
+}
+
+func Test_passthroughURL(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Original string
+		Suffix   string
+		Query    string
+		Want     string
+		WantErr  bool
+	}{
+		{Name: "Nothing to add", Original: "https://a.ru/p?x=1", Want: "https://a.ru/p?x=1"},
+		{Name: "Query", Original: "https://a.ru/p", Query: "utm_source=tg&b=2", Want: "https://a.ru/p?b=2&utm_source=tg"},
+		{Name: "Original wins", Original: "https://a.ru/p?ref=owner&z=1", Query: "ref=visitor&ref=again&y=2", Want: "https://a.ru/p?ref=owner&z=1&y=2"},
+		{Name: "Suffix", Original: "https://a.ru/docs/", Suffix: "v2/index.html", Want: "https://a.ru/docs/v2/index.html"},
+		{Name: "Suffix without path", Original: "https://a.ru", Suffix: "x", Want: "https://a.ru/x"},
+		{Name: "Escaped suffix", Original: "https://a.ru/p", Suffix: "a%2Fb/c%20d", Want: "https://a.ru/p/a%2Fb/c%20d"},
+		{Name: "Suffix and query", Original: "https://a.ru/p?x=1#top", Suffix: "q", Query: "y=2", Want: "https://a.ru/p/q?x=1&y=2#top"},
+		{Name: "Dot dot", Original: "https://a.ru/p", Suffix: "../admin", WantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.Query)
+			require.NoError(t, err)
+			got, err := passthroughURL(tc.Original, tc.Suffix, query)
+			if tc.WantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.Want, got)
+		})
+	}
+}
+
+func Test_GetHandlerPassthrough(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil)}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+	for _, body := range []string{
+		`{"url": "https://docs.ru/v1?lang=en", "alias": "docs", "passthrough": true}`,
+		`{"url": "https://plain.ru/page", "alias": "plain"}`,
+	} {
+		resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+			body: bytes.NewBufferString(body)})
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode, body)
+	}
+
+	tests := []struct {
+		Name         string
+		Path         string
+		WantCode     int
+		WantLocation string
+	}{
+		{Name: "Passthrough as is", Path: "/docs", WantCode: http.StatusTemporaryRedirect, WantLocation: "https://docs.ru/v1?lang=en"},
+		{Name: "Passthrough everything", Path: "/docs/api/get?lang=ru&utm_source=mail", WantCode: http.StatusTemporaryRedirect,
+			WantLocation: "https://docs.ru/v1/api/get?lang=en&utm_source=mail"},
+		{Name: "Passthrough trailing slash", Path: "/docs/", WantCode: http.StatusTemporaryRedirect, WantLocation: "https://docs.ru/v1?lang=en"},
+		{Name: "Plain ignores the query", Path: "/plain?utm_source=mail", WantCode: http.StatusTemporaryRedirect, WantLocation: "https://plain.ru/page"},
+		{Name: "Plain has no suffix", Path: "/plain/extra", WantCode: http.StatusBadRequest},
+		{Name: "Unknown with suffix", Path: "/nope/extra", WantCode: http.StatusBadRequest},
+		{Name: "Dot dot", Path: "/docs/%2E%2E/admin", WantCode: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: tc.Path})
+			resp.Body.Close()
+			require.Equal(t, tc.WantCode, resp.StatusCode)
+			require.Equal(t, tc.WantLocation, resp.Header.Get("Location"))
+		})
+	}
+}
+
+func Test_UTMTemplates(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil)}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+	owner := userCookie(testConnect, "marketing")
+	other := userCookie(testConnect, "other")
+
+	tests := []struct {
+		Name     string
+		Body     string
+		Cookie   *http.Cookie
+		WantCode int
+	}{
+		{Name: "Create", Body: `{"name": "spring", "utm_source": "newsletter", "utm_medium": "email", "utm_campaign": "spring-sale"}`,
+			Cookie: owner, WantCode: http.StatusCreated},
+		{Name: "Same name", Body: `{"name": "spring", "utm_source": "tg"}`, Cookie: owner, WantCode: http.StatusConflict},
+		{Name: "Same name of another user", Body: `{"name": "spring", "utm_source": "vk"}`, Cookie: other, WantCode: http.StatusCreated},
+		{Name: "No source", Body: `{"name": "empty"}`, Cookie: owner, WantCode: http.StatusBadRequest},
+		{Name: "Bad name", Body: `{"name": "a b", "utm_source": "tg"}`, Cookie: owner, WantCode: http.StatusBadRequest},
+		{Name: "No user", Body: `{"name": "anon", "utm_source": "tg"}`, WantCode: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			var cookies []*http.Cookie
+			if tc.Cookie != nil {
+				cookies = append(cookies, tc.Cookie)
+			}
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/utm-templates",
+				body: bytes.NewBufferString(tc.Body), cookies: cookies})
+			resp.Body.Close()
+			require.Equal(t, tc.WantCode, resp.StatusCode)
+		})
+	}
+
+	resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/api/utm-templates",
+		cookies: []*http.Cookie{owner}})
+	var list []models.UTMTemplate
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, []models.UTMTemplate{{Name: "spring", Source: "newsletter", Medium: "email", Campaign: "spring-sale"}}, list)
+
+	// the template is checked on creation and added on redirect, the own parameters of the URL win
+	for _, tc := range []struct {
+		Body     string
+		WantCode int
+	}{
+		{Body: `{"url": "https://shop.ru/sale?utm_medium=banner", "alias": "sale", "utm_template": "spring", "passthrough": true}`,
+			WantCode: http.StatusCreated},
+		{Body: `{"url": "https://shop.ru/other", "utm_template": "autumn"}`, WantCode: http.StatusBadRequest},
+	} {
+		resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+			body: bytes.NewBufferString(tc.Body), cookies: []*http.Cookie{owner}})
+		resp.Body.Close()
+		require.Equal(t, tc.WantCode, resp.StatusCode, tc.Body)
+	}
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/sale?utm_source=visitor&page=2"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	require.Equal(t, "https://shop.ru/sale?utm_medium=banner&utm_campaign=spring-sale&utm_source=newsletter&page=2",
+		resp.Header.Get("Location"))
+}
+
+func Test_GetHandlerDeviceRules(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil)}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		Body     string
+		WantCode int
+	}{
+		{Body: `{"url": "https://app.ru", "alias": "app", "device_rules": [
+			{"os": "ios", "url": "https://apps.apple.com/app/id1"},
+			{"os": "android", "device": "mobile", "url": "https://play.google.com/store/apps/details?id=ru.app"},
+			{"device": "desktop", "url": "https://app.ru/web"}]}`, WantCode: http.StatusCreated},
+		{Body: `{"url": "https://x.ru", "device_rules": [{"url": "https://y.ru"}]}`, WantCode: http.StatusBadRequest},
+		{Body: `{"url": "https://x.ru", "device_rules": [{"os": "symbian", "url": "https://y.ru"}]}`, WantCode: http.StatusBadRequest},
+		{Body: `{"url": "https://x.ru", "device_rules": [{"device": "fridge", "url": "https://y.ru"}]}`, WantCode: http.StatusBadRequest},
+		{Body: `{"url": "https://x.ru", "device_rules": [{"os": "ios"}]}`, WantCode: http.StatusBadRequest},
+	} {
+		resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+			body: bytes.NewBufferString(tc.Body)})
+		resp.Body.Close()
+		require.Equal(t, tc.WantCode, resp.StatusCode, tc.Body)
+	}
+
+	tests := []struct {
+		Name         string
+		UserAgent    string
+		WantLocation string
+	}{
+		{Name: "iPhone", UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) Mobile/15E148 Safari/604.1",
+			WantLocation: "https://apps.apple.com/app/id1"},
+		{Name: "Android phone", UserAgent: "Mozilla/5.0 (Linux; Android 14; Pixel 8) Chrome/124.0.0.0 Mobile Safari/537.36",
+			WantLocation: "https://play.google.com/store/apps/details?id=ru.app"},
+		{Name: "Android tablet falls back", UserAgent: "Mozilla/5.0 (Linux; Android 13; SM-X200) Chrome/124.0.0.0 Safari/537.36",
+			WantLocation: "https://app.ru"},
+		{Name: "Desktop", UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/124.0.0.0 Safari/537.36",
+			WantLocation: "https://app.ru/web"},
+		{Name: "Bot falls back", UserAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			WantLocation: "https://app.ru"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/app",
+				header: http.Header{"User-Agent": {tc.UserAgent}}})
+			resp.Body.Close()
+			require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+			require.Equal(t, tc.WantLocation, resp.Header.Get("Location"))
+			require.Equal(t, "User-Agent", resp.Header.Get("Vary"))
+		})
+	}
+}
+
+func Test_GetHandlerVariants(t *testing.T) {
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil)}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+	owner := userCookie(testConnect, "growth")
+	// variantCookies drops the user cookie every anonymous visitor gets
+	variantCookies := func(resp *http.Response) []*http.Cookie {
+		var cookies []*http.Cookie
+		for _, cookie := range resp.Cookies() {
+			if strings.HasPrefix(cookie.Name, "ab_") {
+				cookies = append(cookies, cookie)
+			}
+		}
+		return cookies
+	}
+
+	for _, tc := range []struct {
+		Body     string
+		WantCode int
+	}{
+		{Body: `{"url": "https://land.ru", "alias": "split", "variants": [
+			{"url": "https://land.ru/a", "weight": 3}, {"url": "https://land.ru/b", "weight": 1}, {"url": "https://land.ru/off", "weight": 0}]}`,
+			WantCode: http.StatusCreated},
+		{Body: `{"url": "https://sticky.ru", "alias": "sticky", "sticky": true, "variants": [
+			{"url": "https://sticky.ru/a", "weight": 1}, {"url": "https://sticky.ru/b", "weight": 1}]}`, WantCode: http.StatusCreated},
+		{Body: `{"url": "https://x.ru", "variants": [{"url": "https://x.ru/a", "weight": 0}]}`, WantCode: http.StatusBadRequest},
+		{Body: `{"url": "https://x.ru", "variants": [{"url": "https://x.ru/a", "weight": -1}, {"url": "https://x.ru/b", "weight": 2}]}`,
+			WantCode: http.StatusBadRequest},
+		{Body: `{"url": "https://x.ru", "variants": [{"weight": 1}]}`, WantCode: http.StatusBadRequest},
+		{Body: `{"url": "https://x.ru", "sticky": true}`, WantCode: http.StatusBadRequest},
+	} {
+		resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+			body: bytes.NewBufferString(tc.Body), cookies: []*http.Cookie{owner}})
+		resp.Body.Close()
+		require.Equal(t, tc.WantCode, resp.StatusCode, tc.Body)
+	}
+
+	// the variants are picked by weight, the one with weight 0 never
+	const visits = 400
+	seen := map[string]int{}
+	for i := 0; i < visits; i++ {
+		resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/split"})
+		resp.Body.Close()
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		require.Empty(t, variantCookies(resp)) // not sticky
+		seen[resp.Header.Get("Location")]++
+	}
+	require.Len(t, seen, 2)
+	require.Greater(t, seen["https://land.ru/a"], seen["https://land.ru/b"])
+
+	// the clicks of every variant are in the stats, only for the owner
+	resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/api/urls/split/stats",
+		cookies: []*http.Cookie{owner}})
+	var stats models.URLStats
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, models.URLStats{
+		ShortURL:    config.BaseURL + "split",
+		OriginalURL: "https://land.ru",
+		Variants: []models.VariantStats{
+			{URL: "https://land.ru/a", Weight: 3, Clicks: int64(seen["https://land.ru/a"])},
+			{URL: "https://land.ru/b", Weight: 1, Clicks: int64(seen["https://land.ru/b"])},
+			{URL: "https://land.ru/off", Weight: 0, Clicks: 0},
+		},
+	}, stats)
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/api/urls/split/stats",
+		cookies: []*http.Cookie{userCookie(testConnect, "stranger")}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// a sticky link remembers the variant in a cookie
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/sticky"})
+	resp.Body.Close()
+	first := resp.Header.Get("Location")
+	cookies := variantCookies(resp)
+	require.Len(t, cookies, 1)
+	require.Equal(t, "ab_sticky", cookies[0].Name)
+	for i := 0; i < 20; i++ {
+		resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/sticky", cookies: cookies})
+		resp.Body.Close()
+		require.Equal(t, first, resp.Header.Get("Location"))
+	}
+	// a broken cookie gets a new variant
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/sticky",
+		cookies: []*http.Cookie{{Name: "ab_sticky", Value: "7"}}})
+	resp.Body.Close()
+	require.Contains(t, []string{"https://sticky.ru/a", "https://sticky.ru/b"}, resp.Header.Get("Location"))
+	require.Len(t, variantCookies(resp), 1)
+}
+
+func Test_GetHandlerActiveWindow(t *testing.T) {
+	launch := time.Date(2030, time.March, 1, 12, 0, 0, 0, time.UTC)
+	now := launch.Add(-time.Hour)
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil), clock: func() time.Time { return now }}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+	from, until := launch.Format(time.RFC3339), launch.Add(24*time.Hour).Format(time.RFC3339)
+
+	for _, tc := range []struct {
+		Body     string
+		WantCode int
+	}{
+		{Body: `{"url": "https://launch.ru", "alias": "launch", "active_from": "` + from + `", "prelaunch_url": "https://launch.ru/teaser",
+			"active_until": "` + until + `", "post_expiry_url": "https://launch.ru/archive"}`, WantCode: http.StatusCreated},
+		{Body: `{"url": "https://bare.ru", "alias": "bare", "active_from": "` + from + `", "active_until": "` + until + `"}`,
+			WantCode: http.StatusCreated},
+		{Body: `{"url": "https://vip.ru", "alias": "vip", "password": "open sesame", "active_from": "` + from + `",
+			"prelaunch_url": "https://vip.ru/soon", "active_until": "` + until + `", "post_expiry_url": "https://vip.ru/over"}`,
+			WantCode: http.StatusCreated},
+		{Body: `{"url": "https://x.ru", "active_from": "` + until + `", "active_until": "` + from + `"}`, WantCode: http.StatusBadRequest},
+		{Body: `{"url": "https://x.ru", "prelaunch_url": "https://x.ru/soon"}`, WantCode: http.StatusBadRequest},
+		{Body: `{"url": "https://x.ru", "post_expiry_url": "https://x.ru/over"}`, WantCode: http.StatusBadRequest},
+		{Body: `{"url": "https://x.ru", "active_until": "` + now.Format(time.RFC3339) + `"}`, WantCode: http.StatusBadRequest},
+	} {
+		resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+			body: bytes.NewBufferString(tc.Body)})
+		resp.Body.Close()
+		require.Equal(t, tc.WantCode, resp.StatusCode, tc.Body)
+	}
+
+	tests := []struct {
+		Name         string
+		Now          time.Time
+		Method       string
+		Path         string
+		WantCode     int
+		WantLocation string
+	}{
+		{Name: "Before launch", Now: launch.Add(-time.Second), Path: "/launch", WantCode: http.StatusTemporaryRedirect,
+			WantLocation: "https://launch.ru/teaser"},
+		{Name: "Before launch without fallback", Now: launch.Add(-time.Second), Path: "/bare", WantCode: http.StatusNotFound},
+		{Name: "At launch", Now: launch, Path: "/launch", WantCode: http.StatusTemporaryRedirect, WantLocation: "https://launch.ru"},
+		{Name: "Active", Now: launch.Add(time.Hour), Path: "/bare", WantCode: http.StatusTemporaryRedirect, WantLocation: "https://bare.ru"},
+		{Name: "Over", Now: launch.Add(24 * time.Hour), Path: "/launch", WantCode: http.StatusTemporaryRedirect,
+			WantLocation: "https://launch.ru/archive"},
+		{Name: "Over without fallback", Now: launch.Add(25 * time.Hour), Path: "/bare", WantCode: http.StatusGone},
+		// the posted password must not be posted again to the fallback URL
+		{Name: "Password before launch", Now: launch.Add(-time.Second), Method: http.MethodPost, Path: "/vip",
+			WantCode: http.StatusSeeOther, WantLocation: "https://vip.ru/soon"},
+		{Name: "Password over", Now: launch.Add(24 * time.Hour), Method: http.MethodPost, Path: "/vip",
+			WantCode: http.StatusSeeOther, WantLocation: "https://vip.ru/over"},
+		{Name: "Protected over", Now: launch.Add(24 * time.Hour), Path: "/vip", WantCode: http.StatusTemporaryRedirect,
+			WantLocation: "https://vip.ru/over"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			now = tc.Now
+			method, body := http.MethodGet, io.Reader(nil)
+			if tc.Method == http.MethodPost {
+				method, body = http.MethodPost, strings.NewReader("password=open+sesame")
+			}
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: method, path: tc.Path, body: body,
+				header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}})
+			resp.Body.Close()
+			require.Equal(t, tc.WantCode, resp.StatusCode)
+			require.Equal(t, tc.WantLocation, resp.Header.Get("Location"))
+		})
+	}
+
+	// the URL of a closed link can be shortened again, the old link keeps redirecting to its archive
+	now = launch.Add(25 * time.Hour)
+	repost := func(original string) (int, string) {
+		resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/", body: bytes.NewBufferString(original)})
+		link, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, linkPath(t, string(link))
+	}
+	code, path := repost("https://launch.ru")
+	require.Equal(t, http.StatusCreated, code)
+	resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: path})
+	resp.Body.Close()
+	require.Equal(t, "https://launch.ru", resp.Header.Get("Location"))
+	resp = testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: "/launch"})
+	resp.Body.Close()
+	require.Equal(t, "https://launch.ru/archive", resp.Header.Get("Location"))
+
+	// not before the window is over
+	now = launch.Add(time.Hour)
+	code, path = repost("https://bare.ru")
+	require.Equal(t, http.StatusConflict, code)
+	require.Equal(t, "/bare", path)
+}
+
+// fakeGeo knows the countries of some addresses instead of a MaxMind DB
+type fakeGeo map[string]string
+
+func (g fakeGeo) Country(ip net.IP) (string, error) {
+	return g[ip.String()], nil
+}
+
+func Test_GetHandlerGeoRules(t *testing.T) {
+	old := config.TrustedProxies
+	defer func() { config.TrustedProxies = old }()
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	config.TrustedProxies = []*net.IPNet{loopback} // the test client plays the proxy
+
+	// without a database the geo rules are refused
+	noGeo := httptest.NewServer(LaunchMyRouter(&Connection{store: storage.NewMemoryStorage(nil)}))
+	resp := testRequest(testRequestOptions{t: t, ts: noGeo, method: http.MethodPost, path: "/api/shorten",
+		body: bytes.NewBufferString(`{"url": "https://x.ru", "geo_rules": [{"countries": ["DE"], "url": "https://x.de"}]}`)})
+	resp.Body.Close()
+	noGeo.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	testConnect := &Connection{store: storage.NewMemoryStorage(nil), geo: fakeGeo{
+		"198.51.100.1": "DE", "198.51.100.2": "AT", "198.51.100.3": "FR", "2001:db8::1": "US",
+	}}
+	ts := httptest.NewServer(LaunchMyRouter(testConnect))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		Body     string
+		WantCode int
+	}{
+		{Body: `{"url": "https://shop.com", "alias": "shop", "redirect_type": 308, "geo_rules": [
+			{"countries": ["de", "AT"], "url": "https://shop.de"},
+			{"countries": ["US"], "url": "https://shop.com/us"}]}`, WantCode: http.StatusCreated},
+		{Body: `{"url": "https://app.com", "alias": "app", "device_rules": [{"os": "ios", "url": "https://apps.apple.com/app"}],
+			"geo_rules": [{"countries": ["DE"], "url": "https://app.de"}]}`, WantCode: http.StatusCreated},
+		{Body: `{"url": "https://x.ru", "geo_rules": [{"countries": ["DE"]}]}`, WantCode: http.StatusBadRequest},
+		{Body: `{"url": "https://x.ru", "geo_rules": [{"url": "https://x.de"}]}`, WantCode: http.StatusBadRequest},
+		{Body: `{"url": "https://x.ru", "geo_rules": [{"countries": ["DEU"], "url": "https://x.de"}]}`, WantCode: http.StatusBadRequest},
+		{Body: `{"url": "https://x.ru", "geo_rules": [{"countries": ["D1"], "url": "https://x.de"}]}`, WantCode: http.StatusBadRequest},
+	} {
+		resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+			body: bytes.NewBufferString(tc.Body)})
+		resp.Body.Close()
+		require.Equal(t, tc.WantCode, resp.StatusCode, tc.Body)
+	}
+
+	tests := []struct {
+		Name         string
+		Path         string
+		Forwarded    string
+		UserAgent    string
+		WantLocation string
+	}{
+		{Name: "Germany", Path: "/shop", Forwarded: "198.51.100.1", WantLocation: "https://shop.de"},
+		{Name: "Austria", Path: "/shop", Forwarded: "198.51.100.2", WantLocation: "https://shop.de"},
+		{Name: "IPv6", Path: "/shop", Forwarded: "2001:db8::1", WantLocation: "https://shop.com/us"},
+		{Name: "No rule", Path: "/shop", Forwarded: "198.51.100.3", WantLocation: "https://shop.com"},
+		{Name: "Unknown address", Path: "/shop", Forwarded: "192.0.2.1", WantLocation: "https://shop.com"},
+		{Name: "Spoofed by the client", Path: "/shop", Forwarded: "198.51.100.1, 198.51.100.3", WantLocation: "https://shop.com"},
+		{Name: "No header", Path: "/shop", WantLocation: "https://shop.com"},
+		{Name: "Device rule first", Path: "/app", Forwarded: "198.51.100.1",
+			UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) Mobile/15E148 Safari/604.1", WantLocation: "https://apps.apple.com/app"},
+		{Name: "Geo rule without a device one", Path: "/app", Forwarded: "198.51.100.1",
+			UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/124.0.0.0 Safari/537.36", WantLocation: "https://app.de"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			header := http.Header{}
+			if tc.Forwarded != "" {
+				header.Set("X-Forwarded-For", tc.Forwarded)
+			}
+			if tc.UserAgent != "" {
+				header.Set("User-Agent", tc.UserAgent)
+			}
+			resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: tc.Path, header: header})
+			resp.Body.Close()
+			require.Equal(t, tc.WantLocation, resp.Header.Get("Location"))
+			if tc.Path == "/shop" {
+				// a permanent redirect that depends on the address must not be cached
+				require.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+				require.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+			}
+		})
+	}
+}
+
+func Test_GetHandlerRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "short-url-db.json")
+	store, err := storage.NewFileStorage(path)
+	require.NoError(t, err)
+	ts := httptest.NewServer(LaunchMyRouter(&Connection{store: store}))
+
+	for _, tc := range []struct {
+		Body     string
+		WantCode int
+	}{
+		{Body: `{"url": "https://mirrors.org", "alias": "mirrors", "redirect_type": 301,
+			"rotation": ["https://m1.mirrors.org", "https://m2.mirrors.org", "https://m3.mirrors.org"]}`, WantCode: http.StatusCreated},
+		{Body: `{"url": "https://x.ru", "rotation": ["https://x.ru/1", ""]}`, WantCode: http.StatusBadRequest},
+		{Body: `{"url": "https://x.ru", "rotation": ["https://x.ru/1"], "variants": [{"url": "https://x.ru/a", "weight": 1}]}`,
+			WantCode: http.StatusBadRequest},
+	} {
+		resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+			body: bytes.NewBufferString(tc.Body)})
+		resp.Body.Close()
+		require.Equal(t, tc.WantCode, resp.StatusCode, tc.Body)
+	}
+	mirrors := []string{"https://m1.mirrors.org", "https://m2.mirrors.org", "https://m3.mirrors.org"}
+	get := func(ts *httptest.Server) string {
+		resp, err := ts.Client().Get(ts.URL + "/mirrors") // CheckRedirect is set by testRequest above
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+		assert.Equal(t, "no-store", resp.Header.Get("Cache-Control")) // every click must reach the server
+		return resp.Header.Get("Location")
+	}
+
+	// in order, round and round
+	for i := 0; i < 4; i++ {
+		require.Equal(t, mirrors[i%3], get(ts))
+	}
+
+	// parallel redirects share the mirrors evenly
+	const redirects = 30
+	var mu sync.Mutex
+	got := map[string]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < redirects; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			location := get(ts)
+			mu.Lock()
+			got[location]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, map[string]int{mirrors[0]: 10, mirrors[1]: 10, mirrors[2]: 10}, got)
+	ts.Close()
+	require.NoError(t, store.Close())
+
+	// 34 redirects so far, the restarted server goes on with the next one
+	store, err = storage.NewFileStorage(path)
+	require.NoError(t, err)
+	defer store.Close()
+	ts = httptest.NewServer(LaunchMyRouter(&Connection{store: store}))
+	defer ts.Close()
+	ts.Client().CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	require.Equal(t, mirrors[34%3], get(ts))
+	require.Equal(t, mirrors[35%3], get(ts))
+
+	// a redirect that fails doesn't take a step
+	resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+		body: bytes.NewBufferString(`{"url": "https://docs.org", "alias": "docs", "passthrough": true,
+			"rotation": ["https://m1.docs.org", "https://m2.docs.org"]}`)})
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	for _, tc := range []struct {
+		Path     string
+		WantCode int
+		Want     string
+	}{
+		{Path: "/docs/guide", WantCode: http.StatusTemporaryRedirect, Want: "https://m1.docs.org/guide"},
+		{Path: "/docs/%2E%2E", WantCode: http.StatusBadRequest},
+		{Path: "/docs/guide", WantCode: http.StatusTemporaryRedirect, Want: "https://m2.docs.org/guide"},
+	} {
+		resp, err := ts.Client().Get(ts.URL + tc.Path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, tc.WantCode, resp.StatusCode, tc.Path)
+		require.Equal(t, tc.Want, resp.Header.Get("Location"), tc.Path)
+	}
+}
+
+func Test_GetHandlerFallback(t *testing.T) {
+	var failing atomic.Bool
+	primary := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if failing.Load() {
+			res.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer primary.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close() // the destination is gone
+
+	store := storage.NewMemoryStorage(nil)
+	checker := health.Start(store, 10*time.Millisecond, time.Second, true) // the test servers are on the loopback
+	defer checker.Stop()
+	ts := httptest.NewServer(LaunchMyRouter(&Connection{store: store, health: checker}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		Body     string
+		WantCode int
+	}{
+		{Body: `{"url": "` + primary.URL + `", "alias": "shop", "redirect_type": 301, "fallback_url": "https://mirror.shop.ru",
+			"passthrough": true}`, WantCode: http.StatusCreated},
+		{Body: `{"url": "` + down.URL + `", "alias": "down", "fallback_url": "https://mirror.down.ru"}`, WantCode: http.StatusCreated},
+		{Body: `{"url": "` + down.URL + `/plain", "alias": "plain"}`, WantCode: http.StatusCreated},
+		{Body: `{"url": "https://x.ru", "fallback_url": "https://x.ru"}`, WantCode: http.StatusBadRequest},
+	} {
+		resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodPost, path: "/api/shorten",
+			body: bytes.NewBufferString(tc.Body)})
+		resp.Body.Close()
+		require.Equal(t, tc.WantCode, resp.StatusCode, tc.Body)
+	}
+	get := func(path string) *http.Response {
+		resp := testRequest(testRequestOptions{t: t, ts: ts, method: http.MethodGet, path: path})
+		resp.Body.Close()
+		return resp
+	}
+
+	require.Eventually(t, func() bool {
+		return get("/down").Header.Get("Location") == "https://mirror.down.ru"
+	}, 2*time.Second, 5*time.Millisecond)
+	// without a fallback URL the visitor goes to the original anyway
+	require.Equal(t, down.URL+"/plain", get("/plain").Header.Get("Location"))
+
+	// the primary is fine: its own status, never cached since it may fail any moment
+	resp := get("/shop/item?id=1")
+	require.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	require.Equal(t, primary.URL+"/item?id=1", resp.Header.Get("Location"))
+	require.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	// failing: a temporary redirect to the fallback, the path and the query go along
+	failing.Store(true)
+	require.Eventually(t, func() bool {
+		return get("/shop").Header.Get("Location") == "https://mirror.shop.ru"
+	}, 2*time.Second, 5*time.Millisecond)
+	resp = get("/shop/item?id=1")
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	require.Equal(t, "https://mirror.shop.ru/item?id=1", resp.Header.Get("Location"))
+
+	// back to the primary once it recovers
+	failing.Store(false)
+	require.Eventually(t, func() bool {
+		return get("/shop").Header.Get("Location") == primary.URL
+	}, 2*time.Second, 5*time.Millisecond)
+
+	// by default the server probes no private networks
+	store2 := storage.NewMemoryStorage(nil)
+	strict := health.Start(store2, time.Hour, time.Second, false)
+	defer strict.Stop()
+	ts2 := httptest.NewServer(LaunchMyRouter(&Connection{store: store2, health: strict}))
+	defer ts2.Close()
+	for _, tc := range []struct {
+		Body     string
+		WantCode int
+	}{
+		{Body: `{"url": "` + primary.URL + `", "fallback_url": "https://mirror.shop.ru"}`, WantCode: http.StatusBadRequest},
+		{Body: `{"url": "http://169.254.169.254/latest", "fallback_url": "https://mirror.shop.ru"}`, WantCode: http.StatusBadRequest},
+		{Body: `{"url": "` + primary.URL + `/plain"}`, WantCode: http.StatusCreated}, // never probed
+		{Body: `{"url": "https://93.184.215.14", "fallback_url": "https://mirror.shop.ru"}`, WantCode: http.StatusCreated},
+	} {
+		resp := testRequest(testRequestOptions{t: t, ts: ts2, method: http.MethodPost, path: "/api/shorten",
+			body: bytes.NewBufferString(tc.Body)})
+		resp.Body.Close()
+		require.Equal(t, tc.WantCode, resp.StatusCode, tc.Body)
+	}
+}
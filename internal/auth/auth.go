@@ -0,0 +1,110 @@
+// Package auth identifies users by a signed cookie with their ID
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	CookieName   = "user_id"
+	cookieMaxAge = 365 * 24 * time.Hour
+	secretSize   = 32 // bytes of a generated secret
+)
+
+// User is the owner of the request
+type User struct {
+	ID string
+	// New is true when the request came without a valid cookie
+	// and the ID has just been issued
+	New bool
+}
+
+type ctxKey struct{}
+
+// Authenticator signs and checks the user cookies with HMAC-SHA256
+type Authenticator struct {
+	secret []byte
+}
+
+// New creates the authenticator with the secret key
+func New(secret []byte) *Authenticator {
+	return &Authenticator{secret: secret}
+}
+
+// RandomSecret generates a secret key, the cookies signed with it
+// become invalid after restart
+func RandomSecret() []byte {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return secret
+}
+
+// sign returns the signature of the user ID
+func (a *Authenticator) sign(userID string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(userID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the cookie value: "<user id>.<signature>"
+func (a *Authenticator) Sign(userID string) string {
+	return userID + "." + a.sign(userID)
+}
+
+// Verify checks the cookie value and returns the user ID from it
+func (a *Authenticator) Verify(value string) (string, bool) {
+	userID, sig, ok := strings.Cut(value, ".")
+	if !ok || userID == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sig), []byte(a.sign(userID))) {
+		return "", false
+	}
+	return userID, true
+}
+
+// Middleware puts the User into the request context. The user is taken from
+// a valid cookie, otherwise a new ID is issued and sent back in a cookie.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var user User
+		if cookie, err := req.Cookie(CookieName); err == nil {
+			user.ID, _ = a.Verify(cookie.Value)
+		}
+		if user.ID == "" {
+			user = User{ID: uuid.NewString(), New: true}
+			http.SetCookie(res, &http.Cookie{
+				Name:     CookieName,
+				Value:    a.Sign(user.ID),
+				Path:     "/",
+				MaxAge:   int(cookieMaxAge.Seconds()),
+				HttpOnly: true,
+				Secure:   req.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		next.ServeHTTP(res, req.WithContext(WithUser(req.Context(), user)))
+	})
+}
+
+// WithUser returns the context carrying the user
+func WithUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, ctxKey{}, user)
+}
+
+// FromContext returns the user put by Middleware
+func FromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(ctxKey{}).(User)
+	return user, ok
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerify(t *testing.T) {
+	a := New([]byte("secret"))
+	value := a.Sign("user-1")
+
+	userID, ok := a.Verify(value)
+	require.True(t, ok)
+	require.Equal(t, "user-1", userID)
+
+	tests := []struct {
+		Name  string
+		Value string
+	}{
+		{Name: "Other user", Value: "user-2" + value[len("user-1"):]},
+		{Name: "No signature", Value: "user-1"},
+		{Name: "Empty user", Value: "." + a.sign("")},
+		{Name: "Other secret", Value: New([]byte("other")).Sign("user-1")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, ok := a.Verify(tc.Value)
+			require.False(t, ok)
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	a := New([]byte("secret"))
+	var got User
+	handler := a.Middleware(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		got, _ = FromContext(req.Context())
+	}))
+
+	// no cookie: a new user with a cookie
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.True(t, got.New)
+	require.NotEmpty(t, got.ID)
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.Equal(t, CookieName, cookies[0].Name)
+	require.True(t, cookies[0].HttpOnly)
+	firstID := got.ID
+
+	// the cookie identifies the same user and no new cookie is set
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.False(t, got.New)
+	require.Equal(t, firstID, got.ID)
+	require.Empty(t, rec.Result().Cookies())
+
+	// a forged cookie is replaced
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: "admin.forged"})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.True(t, got.New)
+	require.NotEqual(t, "admin", got.ID)
+	require.Len(t, rec.Result().Cookies(), 1)
+}
@@ -0,0 +1,132 @@
+// Package deleter soft-deletes the user links in the background, so the
+// handler can answer right away. Requests are collected into batches and
+// written to the storage by a pool of workers.
+package deleter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/absurd678/skill/internal/storage"
+)
+
+// ErrClosed is returned by Enqueue after Close
+var ErrClosed = errors.New("deleter: closed")
+
+const (
+	DefaultWorkers    = 4
+	DefaultBatchSize  = 500             // short URLs a worker collects before writing
+	DefaultFlushEvery = 1 * time.Second // how long a short URL may wait in a batch
+	queueSize         = 1024            // requests waiting for a worker
+	storageTimeout    = 10 * time.Second
+)
+
+// task is one DELETE request
+type task struct {
+	userID    string
+	shortURLs []string
+}
+
+// Deleter is a pool of workers marking the links deleted
+type Deleter struct {
+	store      storage.Storage
+	batchSize  int
+	flushEvery time.Duration
+
+	mu     sync.RWMutex // guards closed against sending to the closed channel
+	closed bool
+	tasks  chan task
+	wg     sync.WaitGroup
+}
+
+// New starts the workers
+func New(store storage.Storage, workers, batchSize int, flushEvery time.Duration) *Deleter {
+	d := &Deleter{
+		store:      store,
+		batchSize:  batchSize,
+		flushEvery: flushEvery,
+		tasks:      make(chan task, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	return d
+}
+
+// Enqueue schedules deletion of the user's short URLs. It waits only if the
+// queue is full, until ctx is done.
+func (d *Deleter) Enqueue(ctx context.Context, userID string, shortURLs []string) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+	select {
+	case d.tasks <- task{userID: userID, shortURLs: shortURLs}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting requests and waits until the queued ones are written
+func (d *Deleter) Close() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.tasks)
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+// work collects the tasks into a batch and flushes it when it is big or old enough
+func (d *Deleter) work() {
+	defer d.wg.Done()
+
+	batch := map[string][]string{} // user ID -> short URLs
+	size := 0
+	ticker := time.NewTicker(d.flushEvery)
+	defer ticker.Stop()
+
+	flush := func() {
+		if size == 0 {
+			return
+		}
+		d.flush(batch)
+		batch = map[string][]string{}
+		size = 0
+	}
+
+	for {
+		select {
+		case t, ok := <-d.tasks:
+			if !ok {
+				flush()
+				return
+			}
+			batch[t.userID] = append(batch[t.userID], t.shortURLs...)
+			size += len(t.shortURLs)
+			if size >= d.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// flush writes the batch to the storage, one call per user
+func (d *Deleter) flush(batch map[string][]string) {
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+	for userID, shortURLs := range batch {
+		if err := d.store.DeleteUserURLs(ctx, userID, shortURLs); err != nil {
+			log.Printf("deleter: user %s: %s", userID, err)
+		}
+	}
+}
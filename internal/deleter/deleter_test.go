@@ -0,0 +1,66 @@
+package deleter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absurd678/skill/internal/models"
+	"github.com/absurd678/skill/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// countStorage counts the DeleteUserURLs calls
+type countStorage struct {
+	storage.Storage
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *countStorage) DeleteUserURLs(ctx context.Context, userID string, shortURLs []string) error {
+	s.mu.Lock()
+	s.calls++
+	s.mu.Unlock()
+	return s.Storage.DeleteUserURLs(ctx, userID, shortURLs)
+}
+
+func TestDeleter(t *testing.T) {
+	ctx := context.Background()
+	st := &countStorage{Storage: storage.NewMemoryStorage(nil)}
+	const links = 100
+	for i := 0; i < links; i++ {
+		short := fmt.Sprintf("id%d", i)
+		require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: short, OriginalURL: "https://" + short, UserID: "user-1"}))
+	}
+
+	// a long flush interval: only the batch size and Close flush
+	d := New(st, 1, 50, time.Hour)
+	for i := 0; i < links; i++ {
+		require.NoError(t, d.Enqueue(ctx, "user-1", []string{fmt.Sprintf("id%d", i)}))
+	}
+	d.Close()
+	require.ErrorIs(t, d.Enqueue(ctx, "user-1", []string{"id0"}), ErrClosed)
+
+	// 100 requests in 2 batches
+	require.Equal(t, 2, st.calls)
+	list, err := st.ListByUser(ctx, "user-1", "", links)
+	require.NoError(t, err)
+	require.Empty(t, list)
+}
+
+func TestDeleterFlushEvery(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewMemoryStorage(nil)
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "a", OriginalURL: "https://a.ru", UserID: "user-1"}))
+
+	d := New(st, 2, DefaultBatchSize, 10*time.Millisecond)
+	defer d.Close()
+	require.NoError(t, d.Enqueue(ctx, "user-1", []string{"a"}))
+
+	require.Eventually(t, func() bool {
+		rec, err := st.Get(ctx, "a")
+		return err == nil && rec.DeletedFlag
+	}, time.Second, 5*time.Millisecond)
+}
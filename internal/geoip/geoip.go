@@ -0,0 +1,92 @@
+// Package geoip tells the country of a client from a local MaxMind DB file
+// (GeoLite2-Country, GeoIP2-City and the like), nothing is looked up over the network
+package geoip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// DB is an open database, safe for concurrent use
+type DB struct {
+	reader *maxminddb.Reader
+}
+
+// record is the part of a database entry we need, the Country and City databases have it both
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// Open reads the database file at path
+func Open(path string) (*DB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{reader: reader}, nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country of the address in upper case,
+// "" if the database doesn't know it. The registered country is used when there is no other
+func (d *DB) Country(ip net.IP) (string, error) {
+	if ip == nil {
+		return "", nil
+	}
+	var rec record
+	if err := d.reader.Lookup(ip, &rec); err != nil {
+		return "", err
+	}
+	if rec.Country.ISOCode != "" {
+		return strings.ToUpper(rec.Country.ISOCode), nil
+	}
+	return strings.ToUpper(rec.RegisteredCountry.ISOCode), nil
+}
+
+// Close releases the file
+func (d *DB) Close() error {
+	return d.reader.Close()
+}
+
+// ClientIP returns the address of the client. X-Forwarded-For is only believed when the request
+// comes from one of the trusted proxies: it is read right to left and the first address that is
+// not a trusted proxy is the client. If the header is missing or broken the last trusted hop is
+// returned, nil if even RemoteAddr is not an IP
+func ClientIP(req *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrusted(ip, trusted) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			return ip // whatever is to the left can't be trusted
+		}
+		ip = hop
+		if !isTrusted(ip, trusted) {
+			return ip
+		}
+	}
+	return ip
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// ---------------------------MaxMind DB writer------------------------------
+// Just enough of https://maxmind.github.io/MaxMind-DB/ to build a test database:
+// an IPv6 tree with 24 bit records, the networks must not overlap
+
+const (
+	typeString = 2
+	typeMap    = 7
+	typeUint32 = 6
+	typeArray  = 11
+)
+
+type node struct {
+	records [2]int // a node index, or -1 - data offset, or 0 for nothing (the root is never a child)
+}
+
+func writeControl(buf *bytes.Buffer, kind, size int) {
+	if kind <= typeMap {
+		buf.WriteByte(byte(kind<<5 | size))
+		return
+	}
+	buf.WriteByte(byte(size))
+	buf.WriteByte(byte(kind - typeMap))
+}
+
+// writeValue encodes strings, uint32s, string slices and string keyed maps of those
+func writeValue(buf *bytes.Buffer, value any) {
+	switch v := value.(type) {
+	case string:
+		writeControl(buf, typeString, len(v))
+		buf.WriteString(v)
+	case uint32:
+		writeControl(buf, typeUint32, 4)
+		binary.Write(buf, binary.BigEndian, v)
+	case []string:
+		writeControl(buf, typeArray, len(v))
+		for _, s := range v {
+			writeValue(buf, s)
+		}
+	case map[string]any:
+		writeControl(buf, typeMap, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			writeValue(buf, key)
+			writeValue(buf, v[key])
+		}
+	default:
+		panic("unsupported value")
+	}
+}
+
+// writeDB saves a database with the networks (CIDR -> country code) and returns its path
+func writeDB(t *testing.T, networks map[string]string) string {
+	t.Helper()
+	nodes := []node{{}}
+	data := &bytes.Buffer{}
+	offsets := map[string]int{}
+	for cidr, country := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		ones, bits := network.Mask.Size()
+		ip := network.IP
+		if bits == 32 {
+			ip, ones = append(make(net.IP, 12), ip...), ones+96 // IPv4 lives in ::/96
+		}
+		offset, ok := offsets[country]
+		if !ok {
+			offset = data.Len()
+			offsets[country] = offset
+			writeValue(data, map[string]any{"country": map[string]any{"iso_code": country}})
+		}
+		current := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[current].records[bit] = -1 - offset
+				break
+			}
+			if nodes[current].records[bit] <= 0 {
+				nodes = append(nodes, node{})
+				nodes[current].records[bit] = len(nodes) - 1
+			}
+			current = nodes[current].records[bit]
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	for _, n := range nodes {
+		for _, r := range n.records {
+			value := len(nodes) // nothing
+			switch {
+			case r > 0:
+				value = r
+			case r < 0:
+				value = len(nodes) + 16 + (-1 - r)
+			}
+			buf.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data.Bytes())
+	buf.WriteString("\xAB\xCD\xEFMaxMind.com")
+	writeValue(buf, map[string]any{
+		"binary_format_major_version": uint32(2),
+		"binary_format_minor_version": uint32(0),
+		"build_epoch":                 uint32(1700000000),
+		"database_type":               "Test-Country",
+		"description":                 map[string]any{"en": "test"},
+		"ip_version":                  uint32(6),
+		"languages":                   []string{"en"},
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint32(24),
+	})
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+	return path
+}
+
+// ---------------------------Tests------------------------------
+
+func TestDB_Country(t *testing.T) {
+	db, err := Open(writeDB(t, map[string]string{
+		"203.0.113.0/24":  "de",
+		"198.51.100.0/24": "US",
+		"2001:db8::/32":   "FR",
+	}))
+	require.NoError(t, err)
+	defer db.Close()
+
+	tests := []struct {
+		Name string
+		IP   net.IP
+		Want string
+	}{
+		{Name: "IPv4 upper cased", IP: net.ParseIP("203.0.113.7"), Want: "DE"},
+		{Name: "IPv4", IP: net.ParseIP("198.51.100.200"), Want: "US"},
+		{Name: "IPv6", IP: net.ParseIP("2001:db8::1"), Want: "FR"},
+		{Name: "unknown IPv4", IP: net.ParseIP("192.0.2.1"), Want: ""},
+		{Name: "unknown IPv6", IP: net.ParseIP("2001:db9::1"), Want: ""},
+		{Name: "no IP", IP: nil, Want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			country, err := db.Country(test.IP)
+			require.NoError(t, err)
+			require.Equal(t, test.Want, country)
+		})
+	}
+}
+
+func TestOpen_Broken(t *testing.T) {
+	_, err := Open(filepath.Join(t.TempDir(), "missing.mmdb"))
+	require.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "broken.mmdb")
+	require.NoError(t, os.WriteFile(path, []byte("not a database"), 0644))
+	_, err = Open(path)
+	require.Error(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	trusted := []*net.IPNet{proxies}
+
+	tests := []struct {
+		Name       string
+		RemoteAddr string
+		Forwarded  []string
+		Trusted    []*net.IPNet
+		Want       string
+	}{
+		{Name: "direct", RemoteAddr: "203.0.113.7:1234", Want: "203.0.113.7"},
+		{Name: "header of an untrusted client", RemoteAddr: "203.0.113.7:1234", Forwarded: []string{"198.51.100.1"}, Trusted: trusted, Want: "203.0.113.7"},
+		{Name: "no trusted proxies", RemoteAddr: "10.0.0.1:1234", Forwarded: []string{"198.51.100.1"}, Want: "10.0.0.1"},
+		{Name: "trusted proxy", RemoteAddr: "10.0.0.1:1234", Forwarded: []string{"198.51.100.1"}, Trusted: trusted, Want: "198.51.100.1"},
+		{Name: "spoofed by the client", RemoteAddr: "10.0.0.1:1234", Forwarded: []string{"1.2.3.4, 198.51.100.1"}, Trusted: trusted, Want: "198.51.100.1"},
+		{Name: "proxy chain", RemoteAddr: "10.0.0.1:1234", Forwarded: []string{"198.51.100.1, 10.0.0.2", "10.0.0.3"}, Trusted: trusted, Want: "198.51.100.1"},
+		{Name: "only proxies", RemoteAddr: "10.0.0.1:1234", Forwarded: []string{"10.0.0.2"}, Trusted: trusted, Want: "10.0.0.2"},
+		{Name: "broken hop", RemoteAddr: "10.0.0.1:1234", Forwarded: []string{"198.51.100.1, junk, 10.0.0.2"}, Trusted: trusted, Want: "10.0.0.2"},
+		{Name: "no header", RemoteAddr: "10.0.0.1:1234", Trusted: trusted, Want: "10.0.0.1"},
+		{Name: "IPv6", RemoteAddr: "[2001:db8::1]:1234", Want: "2001:db8::1"},
+		{Name: "not an IP", RemoteAddr: "pipe", Want: "<nil>"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = test.RemoteAddr
+			for _, value := range test.Forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			require.Equal(t, test.Want, ClientIP(req, test.Trusted).String())
+		})
+	}
+}
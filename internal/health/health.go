@@ -0,0 +1,205 @@
+// Package health probes the destinations of the links with a fallback URL in background
+package health
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/absurd678/skill/internal/storage"
+)
+
+const storageTimeout = 30 * time.Second
+const maxParallelProbes = 16 // destinations probed at once
+
+// ErrPrivateAddress is the error for a destination in a loopback, private or link-local network:
+// probing those would let whoever creates a link scan the network of the server
+var ErrPrivateAddress = errors.New("the destination is not a public address")
+
+// Checker sends HEAD to the original URL of every live link with a fallback URL every interval.
+// A destination is down from a failed probe (no answer in time or a 5xx status) till a successful one
+type Checker struct {
+	store   storage.Storage
+	client  *http.Client
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	private bool // the destinations in private networks are probed too
+
+	mu   sync.RWMutex
+	down map[string]bool // the failing destinations of the last round
+}
+
+// Start runs the checker, the first round right away. A probe gives up after timeout.
+// The destinations in private networks are skipped unless private is set
+func Start(store storage.Storage, every, timeout time.Duration, private bool) *Checker {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Checker{
+		store:   store,
+		ctx:     ctx,
+		cancel:  cancel,
+		private: private,
+		down:    map[string]bool{},
+	}
+	dialer := &net.Dialer{Timeout: timeout, Control: c.control}
+	c.client = &http.Client{
+		Timeout: timeout,
+		// no proxy: the address dialed must be the one of the destination, and every probe dials anew
+		Transport: &http.Transport{DialContext: dialer.DialContext, DisableKeepAlives: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse // a redirect is an answer too
+		},
+	}
+	c.wg.Add(1)
+	go c.run(every)
+	return c
+}
+
+// Stop cancels the probes in flight and waits for the checker to finish
+func (c *Checker) Stop() {
+	c.cancel()
+	c.wg.Wait()
+}
+
+// CheckDestination fails with ErrPrivateAddress if the host of the URL resolves to an address the checker
+// doesn't probe. A host that doesn't resolve passes, the addresses are checked again on every dial
+func (c *Checker) CheckDestination(ctx context.Context, rawURL string) error {
+	if c.private {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if !Public(ip.IP) {
+			return ErrPrivateAddress
+		}
+	}
+	return nil
+}
+
+// Public tells whether the address is outside the loopback, private, link-local and unspecified ones
+func Public(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsUnspecified()
+}
+
+// control refuses to connect to the private addresses, the name of the destination is resolved by now
+// so it can't point somewhere else after CheckDestination
+func (c *Checker) control(_, address string, _ syscall.RawConn) error {
+	if c.private {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !Public(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// Healthy tells whether the destination answered the last probe, the ones never probed are healthy
+func (c *Checker) Healthy(url string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.down[url]
+}
+
+func (c *Checker) run(every time.Duration) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		c.check()
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check probes the destinations and replaces the down ones with the result
+func (c *Checker) check() {
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(c.ctx, storageTimeout)
+	list, err := c.store.ListWithFallback(ctx, now)
+	cancel()
+	if err != nil {
+		if c.ctx.Err() == nil {
+			log.Printf("health: %s", err)
+		}
+		return
+	}
+	urls := map[string]bool{}
+	for _, rec := range list {
+		urls[rec.OriginalURL] = true
+	}
+
+	down := map[string]bool{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxParallelProbes)
+	for url := range urls {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(url string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if !c.probe(url) {
+				mu.Lock()
+				down[url] = true
+				mu.Unlock()
+			}
+		}(url)
+	}
+	wg.Wait()
+	if c.ctx.Err() != nil {
+		return // stopped, the probes were cut short
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for url := range down {
+		if !c.down[url] {
+			log.Printf("health: %s is down", url)
+		}
+	}
+	for url := range c.down {
+		if !down[url] && urls[url] {
+			log.Printf("health: %s is back", url)
+		}
+	}
+	c.down = down
+}
+
+// probe tells whether the destination answers HEAD in time without a server error.
+// A private destination is skipped and stays healthy, its state would tell what listens there
+func (c *Checker) probe(url string) bool {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := c.client.Do(req)
+	if errors.Is(err, ErrPrivateAddress) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < http.StatusInternalServerError
+}
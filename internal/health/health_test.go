@@ -0,0 +1,117 @@
+package health
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/absurd678/skill/internal/models"
+	"github.com/absurd678/skill/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecker(t *testing.T) {
+	ctx := context.Background()
+	var failing atomic.Bool
+	var methods atomic.Value
+	flaky := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		methods.Store(req.Method)
+		if failing.Load() {
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		res.WriteHeader(http.StatusOK)
+	}))
+	defer flaky.Close()
+	moved := httptest.NewServer(http.RedirectHandler("https://example.com", http.StatusMovedPermanently))
+	defer moved.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusBadGateway)
+	}))
+	defer broken.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close() // nobody listens there anymore
+
+	st := storage.NewMemoryStorage(nil)
+	for short, original := range map[string]string{
+		"flaky": flaky.URL, "moved": moved.URL, "broken": broken.URL, "slow": slow.URL, "gone": gone.URL,
+	} {
+		require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: short, OriginalURL: original, FallbackURL: "https://mirror.ru"}))
+	}
+	// without a fallback URL nobody needs to know
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "plain", OriginalURL: broken.URL + "/plain"}))
+
+	c := Start(st, 10*time.Millisecond, 50*time.Millisecond, true) // the test servers are on the loopback
+	defer c.Stop()
+
+	require.Eventually(t, func() bool {
+		return !c.Healthy(broken.URL) && !c.Healthy(slow.URL) && !c.Healthy(gone.URL)
+	}, 2*time.Second, 5*time.Millisecond)
+	require.True(t, c.Healthy(flaky.URL))
+	require.True(t, c.Healthy(moved.URL))
+	require.True(t, c.Healthy(broken.URL+"/plain"))
+	require.Equal(t, http.MethodHead, methods.Load())
+
+	// down while it fails, back once it answers
+	failing.Store(true)
+	require.Eventually(t, func() bool { return !c.Healthy(flaky.URL) }, 2*time.Second, 5*time.Millisecond)
+	failing.Store(false)
+	require.Eventually(t, func() bool { return c.Healthy(flaky.URL) }, 2*time.Second, 5*time.Millisecond)
+
+	// a deleted link is not checked anymore
+	require.NoError(t, st.Delete(ctx, "broken"))
+	require.Eventually(t, func() bool { return c.Healthy(broken.URL) }, 2*time.Second, 5*time.Millisecond)
+}
+
+func TestChecker_Private(t *testing.T) {
+	ctx := context.Background()
+	var probed atomic.Bool
+	local := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		probed.Store(true)
+		res.WriteHeader(http.StatusBadGateway)
+	}))
+	defer local.Close()
+
+	st := storage.NewMemoryStorage(nil)
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "local", OriginalURL: local.URL, FallbackURL: "https://mirror.ru"}))
+	c := Start(st, 10*time.Millisecond, 50*time.Millisecond, false)
+	defer c.Stop()
+
+	for _, tc := range []struct {
+		URL     string
+		WantErr bool
+	}{
+		{URL: local.URL, WantErr: true},
+		{URL: "http://localhost:8080/admin", WantErr: true},
+		{URL: "http://10.0.0.1", WantErr: true},
+		{URL: "http://192.168.1.1:22", WantErr: true},
+		{URL: "http://169.254.169.254/latest/meta-data", WantErr: true},
+		{URL: "http://[::1]", WantErr: true},
+		{URL: "http://[fe80::1]", WantErr: true},
+		{URL: "http://0.0.0.0", WantErr: true},
+		{URL: "https://93.184.215.14/page", WantErr: false},
+		{URL: "https://[2606:2800:21f:cb07:6820:80da:af6b:8b2c]", WantErr: false},
+	} {
+		err := c.CheckDestination(ctx, tc.URL)
+		if tc.WantErr {
+			require.ErrorIs(t, err, ErrPrivateAddress, tc.URL)
+		} else {
+			require.NoError(t, err, tc.URL)
+		}
+	}
+
+	// a link that got past the creation check is not dialed either
+	time.Sleep(100 * time.Millisecond)
+	require.False(t, probed.Load())
+	require.True(t, c.Healthy(local.URL))
+	require.NoError(t, c.control("tcp", "93.184.215.14:443", nil))
+	require.ErrorIs(t, c.control("tcp", net.JoinHostPort("127.0.0.1", "80"), nil), ErrPrivateAddress)
+}
@@ -0,0 +1,68 @@
+// Package janitor purges the links expired long enough ago from the storage in background
+package janitor
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/absurd678/skill/internal/storage"
+)
+
+const storageTimeout = 30 * time.Second
+
+// Janitor calls DeleteExpired of the storage every interval. Till the purge an expired link
+// answers 410 and its id can't be taken by another one
+type Janitor struct {
+	store storage.Storage
+	keep  time.Duration // how long the expired links stay
+	now   func() time.Time
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Start runs the janitor that purges the links expired more than keep ago, now is the clock (time.Now if nil)
+func Start(store storage.Storage, every, keep time.Duration, now func() time.Time) *Janitor {
+	if now == nil {
+		now = time.Now
+	}
+	j := &Janitor{store: store, keep: keep, now: now, stop: make(chan struct{})}
+	j.wg.Add(1)
+	go j.run(every)
+	return j
+}
+
+// Stop waits for the janitor to finish
+func (j *Janitor) Stop() {
+	close(j.stop)
+	j.wg.Wait()
+}
+
+func (j *Janitor) run(every time.Duration) {
+	defer j.wg.Done()
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.purge()
+		}
+	}
+}
+
+// purge removes what has expired by now minus keep
+func (j *Janitor) purge() {
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+	deleted, err := j.store.DeleteExpired(ctx, j.now().Add(-j.keep))
+	if err != nil {
+		log.Printf("janitor: %s", err)
+		return
+	}
+	if deleted > 0 {
+		log.Printf("janitor: %d expired links purged", deleted)
+	}
+}
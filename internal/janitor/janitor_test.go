@@ -0,0 +1,34 @@
+package janitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/absurd678/skill/internal/models"
+	"github.com/absurd678/skill/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJanitor(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewMemoryStorage(nil)
+	expiresAt := time.Now().Add(time.Hour)
+	recentlyAt := time.Now().Add(90 * time.Minute)
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "a", OriginalURL: "https://a.ru", ExpiresAt: &expiresAt}))
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "b", OriginalURL: "https://b.ru"}))
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "c", OriginalURL: "https://c.ru", ExpiresAt: &recentlyAt}))
+
+	// the clock is two hours ahead, the links expired less than 45 minutes ago stay
+	j := Start(st, 5*time.Millisecond, 45*time.Minute, func() time.Time { return time.Now().Add(2 * time.Hour) })
+	defer j.Stop()
+
+	require.Eventually(t, func() bool {
+		_, err := st.Get(ctx, "a")
+		return err != nil
+	}, time.Second, 5*time.Millisecond)
+	_, err := st.Get(ctx, "b")
+	require.NoError(t, err)
+	_, err = st.Get(ctx, "c")
+	require.NoError(t, err)
+}
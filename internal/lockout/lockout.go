@@ -0,0 +1,107 @@
+// Package lockout counts failed password attempts and locks the key out after too many of them
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+// Defaults for New
+const (
+	DefaultMaxFailures     = 5
+	DefaultLinkMaxFailures = 100 // for a key shared by all clients, like a link alone
+	DefaultLockFor         = 15 * time.Minute
+)
+
+// sweepAt is the number of keys after which the forgotten ones are dropped
+const sweepAt = 10000
+
+type entry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// Lockout is safe for concurrent use, a key is usually a link and a client address
+type Lockout struct {
+	mu          sync.Mutex
+	maxFailures int
+	lockFor     time.Duration
+	now         func() time.Time
+	entries     map[string]*entry
+}
+
+// New locks a key for lockFor after maxFailures failures in a row,
+// the failures older than lockFor are forgotten. now is the clock (time.Now if nil)
+func New(maxFailures int, lockFor time.Duration, now func() time.Time) *Lockout {
+	if now == nil {
+		now = time.Now
+	}
+	return &Lockout{maxFailures: maxFailures, lockFor: lockFor, now: now, entries: map[string]*entry{}}
+}
+
+// Locked returns how long the key stays locked, 0 if it isn't
+func (l *Lockout) Locked(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[key]
+	if !ok {
+		return 0
+	}
+	return max(e.lockedUntil.Sub(l.now()), 0)
+}
+
+// Fail counts a failed attempt and returns the lock duration if the key has just been locked
+func (l *Lockout) Fail(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if len(l.entries) >= sweepAt {
+		l.sweep(now)
+	}
+	e, ok := l.entries[key]
+	if !ok || now.Sub(e.lastFailure) > l.lockFor {
+		e = &entry{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+	if e.failures < l.maxFailures {
+		return 0
+	}
+	e.failures = 0
+	e.lockedUntil = now.Add(l.lockFor)
+	return l.lockFor
+}
+
+// Reset forgets the failures of the key after a successful attempt
+func (l *Lockout) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// Forgive takes one failure off the key after a successful attempt. It is for a key shared by many
+// clients: a success of one of them must not wipe out the guesses of the others, but the typos of
+// the ones who know the password must not add up to a lock either
+func (l *Lockout) Forgive(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[key]
+	if !ok || e.failures == 0 {
+		return
+	}
+	e.failures--
+	if e.failures == 0 && !l.now().Before(e.lockedUntil) {
+		delete(l.entries, key)
+	}
+}
+
+// sweep drops the keys that are neither locked nor failed recently
+func (l *Lockout) sweep(now time.Time) {
+	for key, e := range l.entries {
+		if now.After(e.lockedUntil) && now.Sub(e.lastFailure) > l.lockFor {
+			delete(l.entries, key)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package lockout
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is moved by hand
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestLockout(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	l := New(3, time.Minute, clock.Now)
+
+	require.Zero(t, l.Fail("a"))
+	require.Zero(t, l.Fail("a"))
+	require.Zero(t, l.Locked("a"))
+	require.Equal(t, time.Minute, l.Fail("a"))
+	require.Equal(t, time.Minute, l.Locked("a"))
+	require.Zero(t, l.Locked("b")) // the keys are independent
+
+	clock.Add(40 * time.Second)
+	require.Equal(t, 20*time.Second, l.Locked("a"))
+	clock.Add(20 * time.Second)
+	require.Zero(t, l.Locked("a"))
+
+	// a success starts the count over
+	require.Zero(t, l.Fail("a"))
+	require.Zero(t, l.Fail("a"))
+	l.Reset("a")
+	require.Zero(t, l.Fail("a"))
+	require.Zero(t, l.Fail("a"))
+	require.Zero(t, l.Locked("a"))
+
+	// old failures are forgotten
+	clock.Add(2 * time.Minute)
+	require.Zero(t, l.Fail("a"))
+	require.Zero(t, l.Locked("a"))
+}
+
+func TestLockoutForgive(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	l := New(3, time.Minute, clock.Now)
+
+	// a typo now and then between the successes never adds up
+	for i := 0; i < 10; i++ {
+		require.Zero(t, l.Fail("link"))
+		l.Forgive("link")
+	}
+	require.Zero(t, l.Locked("link"))
+
+	// a success takes off one failure only, the guesses of others still count
+	require.Zero(t, l.Fail("link"))
+	require.Zero(t, l.Fail("link"))
+	l.Forgive("link")
+	l.Forgive("link")
+	l.Forgive("link") // nothing left to forgive
+	require.Zero(t, l.Fail("link"))
+	require.Zero(t, l.Fail("link"))
+	require.Equal(t, time.Minute, l.Fail("link"))
+	l.Forgive("unknown")
+}
+
+func TestLockoutSweep(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	l := New(3, time.Minute, clock.Now)
+	for i := 0; i < sweepAt; i++ {
+		l.Fail(strconv.Itoa(i))
+	}
+	clock.Add(2 * time.Minute)
+	l.Fail("last")
+	require.Len(t, l.entries, 1)
+}
@@ -1,10 +1,169 @@
 package models
 
+import (
+	"net/url"
+	"time"
+)
+
 type (
 	SomeURL struct {
-		URL string `json:"url"`
+		URL           string       `json:"url"`
+		Alias         string       `json:"alias,omitempty"`           // vanity {id} instead of a generated one
+		TTL           int64        `json:"ttl,omitempty"`             // seconds the link lives, or
+		ExpiresAt     *time.Time   `json:"expires_at,omitempty"`      // the moment it stops working
+		MaxClicks     int64        `json:"max_clicks,omitempty"`      // redirects before the link is gone, 1 for one-time
+		Password      string       `json:"password,omitempty"`        // asked before the redirect
+		RedirectType  int          `json:"redirect_type,omitempty"`   // 301, 302, 307 or 308, the server default if omitted
+		Passthrough   bool         `json:"passthrough,omitempty"`     // forward the query and /{id}/extra/path
+		UTMTemplate   string       `json:"utm_template,omitempty"`    // name of the user's UTM template
+		DeviceRules   []DeviceRule `json:"device_rules,omitempty"`    // other destinations for some devices
+		GeoRules      []GeoRule    `json:"geo_rules,omitempty"`       // other destinations for some countries
+		Variants      []Variant    `json:"variants,omitempty"`        // weighted destinations of an A/B test
+		Sticky        bool         `json:"sticky,omitempty"`          // a returning visitor gets the same variant
+		Rotation      []string     `json:"rotation,omitempty"`        // destinations taken in turn, one per redirect
+		ActiveFrom    *time.Time   `json:"active_from,omitempty"`     // no redirect before, or
+		PrelaunchURL  string       `json:"prelaunch_url,omitempty"`   // the redirect before active_from
+		ActiveUntil   *time.Time   `json:"active_until,omitempty"`    // no redirect since, or
+		PostExpiryURL string       `json:"post_expiry_url,omitempty"` // the redirect since active_until
+		FallbackURL   string       `json:"fallback_url,omitempty"`    // the redirect while url is down
 	}
 	ShortURL struct {
 		URL string `json:"result"`
 	}
+
+	// BatchRequestItem is one URL to shorten in POST /api/shorten/batch
+	BatchRequestItem struct {
+		CorrelationID string `json:"correlation_id"`
+		OriginalURL   string `json:"original_url"`
+	}
+	// BatchResponseItem is the short URL for the BatchRequestItem with the same correlation_id
+	BatchResponseItem struct {
+		CorrelationID string `json:"correlation_id"`
+		ShortURL      string `json:"short_url"`
+	}
+
+	// UserURL is one link in GET /api/user/urls
+	UserURL struct {
+		ShortURL    string `json:"short_url"`
+		OriginalURL string `json:"original_url"`
+	}
+
+	// URLRevision is a destination the link had before it was changed
+	URLRevision struct {
+		Revision    int       `json:"revision"`     // 1, 2, ... in the order of changes
+		OriginalURL string    `json:"original_url"` // the destination before the change
+		ChangedAt   time.Time `json:"changed_at"`
+	}
+	// URLHistory is the answer of GET /api/urls/{id}/history
+	URLHistory struct {
+		ShortURL    string        `json:"short_url"`
+		OriginalURL string        `json:"original_url"` // current destination
+		History     []URLRevision `json:"history"`
+	}
+
+	// URLRecord is a single short -> original URL pair kept by a storage
+	URLRecord struct {
+		UUID          string       `json:"uuid"`
+		ShortURL      string       `json:"short_url"`
+		OriginalURL   string       `json:"original_url"`
+		UserID        string       `json:"user_id,omitempty"` // owner of the link
+		DeletedFlag   bool         `json:"is_deleted,omitempty"`
+		Released      bool         `json:"released,omitempty"`        // a newer link has the original URL, this one is kept for its owner
+		ExpiresAt     *time.Time   `json:"expires_at,omitempty"`      // nil for a link that never expires
+		ClicksLeft    *int64       `json:"clicks_left,omitempty"`     // nil for unlimited redirects
+		PasswordHash  string       `json:"password_hash,omitempty"`   // bcrypt hash, empty for a public link
+		RedirectType  int          `json:"redirect_type,omitempty"`   // HTTP status of the redirect, 0 for the server default
+		Passthrough   bool         `json:"passthrough,omitempty"`     // the query and the path suffix go to the original URL
+		UTMTemplate   string       `json:"utm_template,omitempty"`    // name of the owner's UTM template added on redirect
+		DeviceRules   []DeviceRule `json:"device_rules,omitempty"`    // the first matching one wins over OriginalURL
+		GeoRules      []GeoRule    `json:"geo_rules,omitempty"`       // the first one with the client country, after DeviceRules
+		Variants      []Variant    `json:"variants,omitempty"`        // picked by weight instead of OriginalURL
+		Sticky        bool         `json:"sticky,omitempty"`          // the picked variant is kept in a cookie
+		Rotation      []string     `json:"rotation,omitempty"`        // taken in turn instead of OriginalURL, the storage keeps the cursor
+		ActiveFrom    *time.Time   `json:"active_from,omitempty"`     // the link redirects since, nil for always
+		ActiveUntil   *time.Time   `json:"active_until,omitempty"`    // the link redirects until, nil for ever
+		PrelaunchURL  string       `json:"prelaunch_url,omitempty"`   // where to go before ActiveFrom
+		PostExpiryURL string       `json:"post_expiry_url,omitempty"` // where to go after ActiveUntil
+		FallbackURL   string       `json:"fallback_url,omitempty"`    // where to go while OriginalURL fails the health checks
+	}
+
+	// Variant is one of the destinations of an A/B test, picked with the probability weight / sum of weights
+	Variant struct {
+		URL    string `json:"url"`
+		Weight int    `json:"weight"`
+	}
+
+	// VariantStats is a variant with the redirects to it
+	VariantStats struct {
+		URL    string `json:"url"`
+		Weight int    `json:"weight"`
+		Clicks int64  `json:"clicks"`
+	}
+	// URLStats is the answer of GET /api/urls/{id}/stats
+	URLStats struct {
+		ShortURL    string         `json:"short_url"`
+		OriginalURL string         `json:"original_url"`
+		Variants    []VariantStats `json:"variants"`
+	}
+
+	// DeviceRule sends the clients with the OS and/or the kind of device (see package useragent) to the URL
+	DeviceRule struct {
+		OS     string `json:"os,omitempty"`
+		Device string `json:"device,omitempty"`
+		URL    string `json:"url"`
+	}
+
+	// GeoRule sends the clients from the countries (ISO 3166-1 alpha-2 codes, upper case) to the URL
+	GeoRule struct {
+		Countries []string `json:"countries"`
+		URL       string   `json:"url"`
+	}
+
+	// UTMTemplate is a named set of UTM parameters of a user
+	UTMTemplate struct {
+		Name     string `json:"name"`
+		UserID   string `json:"user_id,omitempty"`
+		Source   string `json:"utm_source"`
+		Medium   string `json:"utm_medium,omitempty"`
+		Campaign string `json:"utm_campaign,omitempty"`
+		Term     string `json:"utm_term,omitempty"`
+		Content  string `json:"utm_content,omitempty"`
+	}
 )
+
+// Expired tells if the link has stopped working by now
+func (r URLRecord) Expired(now time.Time) bool {
+	return r.ExpiresAt != nil && !now.Before(*r.ExpiresAt)
+}
+
+// NotYetActive tells whether the active window of the link hasn't started by now
+func (r URLRecord) NotYetActive(now time.Time) bool {
+	return r.ActiveFrom != nil && now.Before(*r.ActiveFrom)
+}
+
+// NoLongerActive tells whether the active window of the link is over by now
+func (r URLRecord) NoLongerActive(now time.Time) bool {
+	return r.ActiveUntil != nil && !now.Before(*r.ActiveUntil)
+}
+
+// Exhausted tells whether a click-limited link has no redirects left
+func (r URLRecord) Exhausted() bool {
+	return r.ClicksLeft != nil && *r.ClicksLeft <= 0
+}
+
+// Query returns the parameters of the template that are set
+func (t UTMTemplate) Query() url.Values {
+	query := url.Values{}
+	for key, value := range map[string]string{
+		"utm_source":   t.Source,
+		"utm_medium":   t.Medium,
+		"utm_campaign": t.Campaign,
+		"utm_term":     t.Term,
+		"utm_content":  t.Content,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	return query
+}
@@ -0,0 +1,525 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/absurd678/skill/internal/models"
+	"github.com/google/uuid"
+	_ "github.com/jackc/pgx/v5/stdlib" // "pgx" driver
+	_ "modernc.org/sqlite"             // "sqlite" driver, pure Go
+)
+
+const maxQueryArgs = 500 // short URLs in one UPDATE ... IN (...)
+
+// DBStorage keeps the records in a relational database via database/sql.
+// The queries are written to run on both PostgreSQL and SQLite.
+type DBStorage struct {
+	db *sql.DB
+}
+
+// driverName picks the database/sql driver by the DSN:
+// postgres:// and postgresql:// go to pgx, everything else is an SQLite file or URI
+func driverName(dsn string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") ||
+		strings.Contains(dsn, "host=") {
+		return "pgx"
+	}
+	return "sqlite"
+}
+
+// NewDBStorage connects to the database and applies the migrations
+func NewDBStorage(ctx context.Context, dsn string) (*DBStorage, error) {
+	driver := driverName(dsn)
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite" {
+		db.SetMaxOpenConns(1) // SQLite has one writer anyway, this avoids "database is locked"
+	}
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err = migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DBStorage{db: db}, nil
+}
+
+func (d *DBStorage) Save(ctx context.Context, rec models.URLRecord) error {
+	if rec.UUID == "" {
+		rec.UUID = uuid.NewString()
+	}
+	return insertURL(ctx, d.db, rec)
+}
+
+// execQuerier is either *sql.DB or *sql.Tx
+type execQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// insertURL inserts one record and tells which unique column has been hit if any
+func insertURL(ctx context.Context, db execQuerier, rec models.URLRecord) error {
+	deviceRules, err := jsonColumn(rec.DeviceRules)
+	if err != nil {
+		return err
+	}
+	variants, err := jsonColumn(rec.Variants)
+	if err != nil {
+		return err
+	}
+	geoRules, err := jsonColumn(rec.GeoRules)
+	if err != nil {
+		return err
+	}
+	rotation, err := jsonColumn(rec.Rotation)
+	if err != nil {
+		return err
+	}
+	res, err := db.ExecContext(ctx,
+		`INSERT INTO urls (`+urlColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22) ON CONFLICT DO NOTHING`,
+		rec.UUID, rec.ShortURL, rec.OriginalURL, rec.UserID, rec.DeletedFlag, nullTime(rec.ExpiresAt), nullInt(rec.ClicksLeft),
+		rec.PasswordHash, rec.RedirectType, rec.Passthrough, rec.UTMTemplate, deviceRules,
+		variants, rec.Sticky, nullTime(rec.ActiveFrom), nullTime(rec.ActiveUntil), rec.PrelaunchURL, rec.PostExpiryURL, geoRules, rotation, rec.FallbackURL, rec.Released)
+	if err != nil {
+		return err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted > 0 {
+		return nil
+	}
+
+	var short string
+	err = db.QueryRowContext(ctx,
+		`SELECT short_url FROM urls WHERE original_url = $1 AND is_deleted = FALSE AND released = FALSE`, rec.OriginalURL).Scan(&short)
+	if err == nil {
+		return ErrOriginalURLExists
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrShortURLExists
+	}
+	return err
+}
+
+func (d *DBStorage) SaveBatch(ctx context.Context, recs []models.URLRecord) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op after commit
+
+	for _, rec := range recs {
+		if rec.UUID == "" {
+			rec.UUID = uuid.NewString()
+		}
+		if err = insertURL(ctx, tx, rec); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// urlColumns are the columns scanURL expects
+const urlColumns = `uuid, short_url, original_url, user_id, is_deleted, expires_at, clicks_left, password_hash, redirect_type, passthrough, utm_template, device_rules, variants, sticky,
+	active_from, active_until, prelaunch_url, post_expiry_url, geo_rules, rotation, fallback_url, released`
+
+// nullTime turns an optional time into a nullable UTC column value
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+// nullInt turns an optional number into a nullable column value
+func nullInt(n *int64) sql.NullInt64 {
+	if n == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *n, Valid: true}
+}
+
+// jsonColumn encodes a list kept in a text column, "" for an empty one
+func jsonColumn[T any](list []T) (string, error) {
+	if len(list) == 0 {
+		return "", nil
+	}
+	buf, err := json.Marshal(list)
+	return string(buf), err
+}
+
+// rowScanner is either *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanURL reads one record selected with urlColumns
+func scanURL(row rowScanner) (models.URLRecord, error) {
+	rec := models.URLRecord{}
+	var expiresAt, activeFrom, activeUntil sql.NullTime
+	var clicksLeft sql.NullInt64
+	var deviceRules, variants, geoRules, rotation string
+	err := row.Scan(&rec.UUID, &rec.ShortURL, &rec.OriginalURL, &rec.UserID, &rec.DeletedFlag, &expiresAt, &clicksLeft, &rec.PasswordHash,
+		&rec.RedirectType, &rec.Passthrough, &rec.UTMTemplate, &deviceRules,
+		&variants, &rec.Sticky, &activeFrom, &activeUntil, &rec.PrelaunchURL, &rec.PostExpiryURL, &geoRules, &rotation, &rec.FallbackURL, &rec.Released)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.URLRecord{}, ErrNotFound
+	}
+	if err == nil && deviceRules != "" {
+		err = json.Unmarshal([]byte(deviceRules), &rec.DeviceRules)
+	}
+	if err == nil && variants != "" {
+		err = json.Unmarshal([]byte(variants), &rec.Variants)
+	}
+	if err == nil && geoRules != "" {
+		err = json.Unmarshal([]byte(geoRules), &rec.GeoRules)
+	}
+	if err == nil && rotation != "" {
+		err = json.Unmarshal([]byte(rotation), &rec.Rotation)
+	}
+	if expiresAt.Valid {
+		rec.ExpiresAt = &expiresAt.Time
+	}
+	if activeFrom.Valid {
+		rec.ActiveFrom = &activeFrom.Time
+	}
+	if activeUntil.Valid {
+		rec.ActiveUntil = &activeUntil.Time
+	}
+	if clicksLeft.Valid {
+		rec.ClicksLeft = &clicksLeft.Int64
+	}
+	return rec, err
+}
+
+func (d *DBStorage) Get(ctx context.Context, shortURL string) (models.URLRecord, error) {
+	return scanURL(d.db.QueryRowContext(ctx,
+		`SELECT `+urlColumns+` FROM urls WHERE short_url = $1`, shortURL))
+}
+
+func (d *DBStorage) UseClick(ctx context.Context, shortURL string) (models.URLRecord, error) {
+	// the decrement and the check are one statement, so parallel clicks can't overdraw
+	rec, err := scanURL(d.db.QueryRowContext(ctx,
+		`UPDATE urls SET clicks_left = clicks_left - 1 WHERE short_url = $1 AND clicks_left > 0
+		RETURNING `+urlColumns, shortURL))
+	if !errors.Is(err, ErrNotFound) {
+		return rec, err
+	}
+	// not updated: unknown, unlimited or exhausted
+	rec, err = d.Get(ctx, shortURL)
+	if err != nil || rec.ClicksLeft == nil {
+		return rec, err
+	}
+	return rec, ErrNoClicksLeft
+}
+
+func (d *DBStorage) GetByOriginal(ctx context.Context, originalURL string) (models.URLRecord, error) {
+	return scanURL(d.db.QueryRowContext(ctx,
+		`SELECT `+urlColumns+` FROM urls WHERE original_url = $1 AND is_deleted = FALSE AND released = FALSE`, originalURL))
+}
+
+func (d *DBStorage) ReleaseOriginalURL(ctx context.Context, shortURL string) error {
+	res, err := d.db.ExecContext(ctx,
+		`UPDATE urls SET released = TRUE WHERE short_url = $1 AND is_deleted = FALSE AND released = FALSE`, shortURL)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (d *DBStorage) Delete(ctx context.Context, shortURL string) error {
+	if _, err := d.db.ExecContext(ctx, `DELETE FROM url_history WHERE short_url = $1`, shortURL); err != nil {
+		return err
+	}
+	if _, err := d.db.ExecContext(ctx, `DELETE FROM url_variant_clicks WHERE short_url = $1`, shortURL); err != nil {
+		return err
+	}
+	res, err := d.db.ExecContext(ctx, `DELETE FROM urls WHERE short_url = $1`, shortURL)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (d *DBStorage) DeleteUserURLs(ctx context.Context, userID string, shortURLs []string) error {
+	for len(shortURLs) > 0 {
+		chunk := shortURLs[:min(len(shortURLs), maxQueryArgs)]
+		shortURLs = shortURLs[len(chunk):]
+
+		args := []any{userID}
+		placeholders := make([]string, len(chunk))
+		for i, short := range chunk {
+			args = append(args, short)
+			placeholders[i] = "$" + strconv.Itoa(i+2)
+		}
+		_, err := d.db.ExecContext(ctx,
+			`UPDATE urls SET is_deleted = TRUE WHERE user_id = $1 AND short_url IN (`+strings.Join(placeholders, ", ")+`)`,
+			args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DBStorage) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // no-op after commit
+
+	for _, table := range []string{"url_history", "url_variant_clicks"} {
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM `+table+` WHERE short_url IN (SELECT short_url FROM urls WHERE expires_at <= $1)`, now.UTC())
+		if err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM urls WHERE expires_at <= $1`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), tx.Commit()
+}
+
+func (d *DBStorage) UpdateOriginalURL(ctx context.Context, userID, shortURL, originalURL string) (models.URLRecord, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.URLRecord{}, err
+	}
+	defer tx.Rollback() // no-op after commit
+
+	old, err := scanURL(tx.QueryRowContext(ctx,
+		`SELECT `+urlColumns+` FROM urls WHERE short_url = $1 AND user_id = $2 AND is_deleted = FALSE`,
+		shortURL, userID))
+	if err != nil {
+		return models.URLRecord{}, err
+	}
+	if old.OriginalURL == originalURL {
+		return old, nil // nothing changes
+	}
+
+	var taken int
+	err = tx.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM urls WHERE original_url = $1 AND is_deleted = FALSE AND released = FALSE`, originalURL).Scan(&taken)
+	if err != nil {
+		return models.URLRecord{}, err
+	}
+	if taken > 0 {
+		return models.URLRecord{}, ErrOriginalURLExists
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE urls SET original_url = $1, released = FALSE WHERE short_url = $2`, originalURL, shortURL); err != nil {
+		return models.URLRecord{}, err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO url_history (short_url, revision, original_url, changed_at)
+		VALUES ($1, (SELECT COALESCE(MAX(revision), 0) + 1 FROM url_history WHERE short_url = $1), $2, $3)`,
+		shortURL, old.OriginalURL, time.Now().UTC())
+	if err != nil {
+		return models.URLRecord{}, err
+	}
+
+	rec := old
+	rec.OriginalURL = originalURL
+	rec.Released = false
+	return rec, tx.Commit()
+}
+
+func (d *DBStorage) History(ctx context.Context, shortURL string) ([]models.URLRevision, error) {
+	if _, err := d.Get(ctx, shortURL); err != nil {
+		return nil, err
+	}
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT revision, original_url, changed_at FROM url_history WHERE short_url = $1 ORDER BY revision`, shortURL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []models.URLRevision
+	for rows.Next() {
+		var rev models.URLRevision
+		if err = rows.Scan(&rev.Revision, &rev.OriginalURL, &rev.ChangedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, rev)
+	}
+	return history, rows.Err()
+}
+
+func (d *DBStorage) List(ctx context.Context) ([]models.URLRecord, error) {
+	return d.queryURLs(ctx, `SELECT `+urlColumns+` FROM urls`)
+}
+
+func (d *DBStorage) ListWithFallback(ctx context.Context, now time.Time) ([]models.URLRecord, error) {
+	return d.queryURLs(ctx,
+		`SELECT `+urlColumns+` FROM urls WHERE fallback_url <> '' AND is_deleted = FALSE AND released = FALSE AND (expires_at IS NULL OR expires_at > $1)`,
+		now.UTC())
+}
+
+func (d *DBStorage) ListByUser(ctx context.Context, userID string, after string, limit int) ([]models.URLRecord, error) {
+	return d.queryURLs(ctx,
+		`SELECT `+urlColumns+` FROM urls WHERE user_id = $1 AND is_deleted = FALSE AND short_url > $2
+		ORDER BY short_url LIMIT $3`,
+		userID, after, limit)
+}
+
+// queryURLs reads all the records selected with urlColumns
+func (d *DBStorage) queryURLs(ctx context.Context, query string, args ...any) ([]models.URLRecord, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []models.URLRecord
+	for rows.Next() {
+		rec, err := scanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, rec)
+	}
+	return list, rows.Err()
+}
+
+func (d *DBStorage) AddVariantClick(ctx context.Context, shortURL string, variant int) error {
+	if _, err := d.Get(ctx, shortURL); err != nil {
+		return err
+	}
+	_, err := d.db.ExecContext(ctx,
+		`INSERT INTO url_variant_clicks (short_url, variant, clicks) VALUES ($1, $2, 1)
+		ON CONFLICT (short_url, variant) DO UPDATE SET clicks = url_variant_clicks.clicks + 1`,
+		shortURL, variant)
+	return err
+}
+
+func (d *DBStorage) NextRotation(ctx context.Context, shortURL string) (int64, error) {
+	// the increment and the read are one statement, so parallel redirects get different steps
+	var rotated int64
+	err := d.db.QueryRowContext(ctx,
+		`UPDATE urls SET rotated = rotated + 1 WHERE short_url = $1 RETURNING rotated`, shortURL).Scan(&rotated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return rotated - 1, nil
+}
+
+func (d *DBStorage) VariantClicks(ctx context.Context, shortURL string) (map[int]int64, error) {
+	if _, err := d.Get(ctx, shortURL); err != nil {
+		return nil, err
+	}
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT variant, clicks FROM url_variant_clicks WHERE short_url = $1`, shortURL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clicks := map[int]int64{}
+	for rows.Next() {
+		var variant int
+		var n int64
+		if err = rows.Scan(&variant, &n); err != nil {
+			return nil, err
+		}
+		clicks[variant] = n
+	}
+	return clicks, rows.Err()
+}
+
+// utmColumns are the columns scanUTMTemplate expects
+const utmColumns = `user_id, name, utm_source, utm_medium, utm_campaign, utm_term, utm_content`
+
+func scanUTMTemplate(row rowScanner) (models.UTMTemplate, error) {
+	var tpl models.UTMTemplate
+	err := row.Scan(&tpl.UserID, &tpl.Name, &tpl.Source, &tpl.Medium, &tpl.Campaign, &tpl.Term, &tpl.Content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UTMTemplate{}, ErrNotFound
+	}
+	return tpl, err
+}
+
+func (d *DBStorage) SaveUTMTemplate(ctx context.Context, tpl models.UTMTemplate) error {
+	res, err := d.db.ExecContext(ctx,
+		`INSERT INTO utm_templates (`+utmColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING`,
+		tpl.UserID, tpl.Name, tpl.Source, tpl.Medium, tpl.Campaign, tpl.Term, tpl.Content)
+	if err != nil {
+		return err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return ErrUTMTemplateExists
+	}
+	return nil
+}
+
+func (d *DBStorage) GetUTMTemplate(ctx context.Context, userID, name string) (models.UTMTemplate, error) {
+	return scanUTMTemplate(d.db.QueryRowContext(ctx,
+		`SELECT `+utmColumns+` FROM utm_templates WHERE user_id = $1 AND name = $2`, userID, name))
+}
+
+func (d *DBStorage) ListUTMTemplates(ctx context.Context, userID string) ([]models.UTMTemplate, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT `+utmColumns+` FROM utm_templates WHERE user_id = $1 ORDER BY name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []models.UTMTemplate{}
+	for rows.Next() {
+		tpl, err := scanUTMTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, tpl)
+	}
+	return list, rows.Err()
+}
+
+func (d *DBStorage) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+func (d *DBStorage) Close() error {
+	return d.db.Close()
+}
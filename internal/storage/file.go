@@ -0,0 +1,463 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/absurd678/skill/internal/models"
+	"github.com/google/uuid"
+)
+
+// compactMinLines is how many lines may be appended before the file is compacted at the least
+var compactMinLines = 10000
+
+// FileStorage keeps the records in memory and appends every change to a
+// file as a JSON line, so the index can be rebuilt after a restart.
+// When the same short URL appears several times the last line wins.
+// The file is rewritten with the current state once it has doubled.
+type FileStorage struct {
+	mu        sync.Mutex // one writer to the file at a time
+	mem       *MemoryStorage
+	path      string
+	file      *os.File
+	out       *lineCounter // the file, counts the lines appended since it was opened
+	enc       *json.Encoder
+	compacted int // lines left by the last rewrite
+}
+
+// lineCounter counts the lines written through it
+type lineCounter struct {
+	w     io.Writer
+	lines int
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.lines += bytes.Count(p[:n], []byte{'\n'})
+	return n, err
+}
+
+// fileLine is one line of the file: the record and, once it has been changed,
+// its whole history (a line without history keeps the earlier one).
+// A line with a template, variant clicks or a rotation cursor has nothing else
+type fileLine struct {
+	models.URLRecord
+	History       []models.URLRevision `json:"history,omitempty"`
+	Template      *models.UTMTemplate  `json:"template,omitempty"`
+	VariantClicks *variantClicks       `json:"variant_clicks,omitempty"`
+	Cursor        *rotationCursor      `json:"rotation_cursor,omitempty"`
+}
+
+// templateLine is how a UTM template is written, read back as fileLine
+type templateLine struct {
+	Template models.UTMTemplate `json:"template"`
+}
+
+// variantClicks are redirects to the A/B variants of a record, they are added up on replay
+type variantClicks struct {
+	ShortURL string        `json:"short_url"`
+	Clicks   map[int]int64 `json:"clicks"`
+}
+
+// clicksLine is how variant clicks are written, read back as fileLine
+type clicksLine struct {
+	VariantClicks variantClicks `json:"variant_clicks"`
+}
+
+// rotationCursor is the number of redirects made by the rotation of a record, the last line wins on replay
+type rotationCursor struct {
+	ShortURL string `json:"short_url"`
+	Rotated  int64  `json:"rotated"`
+}
+
+// cursorLine is how a rotation cursor is written, read back as fileLine
+type cursorLine struct {
+	Cursor rotationCursor `json:"rotation_cursor"`
+}
+
+// NewFileStorage opens (or creates) the file and replays it into memory
+func NewFileStorage(path string) (*FileStorage, error) {
+	f := &FileStorage{mem: NewMemoryStorage(nil), path: path}
+	lines, err := f.replay()
+	if err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	f.out.lines = lines // a file grown before the restart is compacted on the first write
+	return f, nil
+}
+
+// replay reads the file line by line into memory and returns the number of lines read
+func (f *FileStorage) replay() (int, error) {
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return 0, nil // nothing saved yet
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// no limit on the line length, a long record must not keep the server from starting
+	reader := bufio.NewReader(file)
+	line := 0
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		line++
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+		var fl fileLine
+		if err := json.Unmarshal(data, &fl); err != nil {
+			return 0, fmt.Errorf("file storage %s line %d: %w", f.path, line, err)
+		}
+		if fl.Template != nil {
+			f.mem.setUTMTemplate(*fl.Template)
+			continue
+		}
+		if fl.VariantClicks != nil {
+			f.mem.setClicks(fl.VariantClicks.ShortURL, fl.VariantClicks.Clicks)
+			continue
+		}
+		if fl.Cursor != nil {
+			f.mem.setRotated(fl.Cursor.ShortURL, fl.Cursor.Rotated)
+			continue
+		}
+		f.mem.set(fl.URLRecord)
+		if fl.History != nil {
+			f.mem.setHistory(fl.ShortURL, fl.History)
+		}
+	}
+	return line, nil
+}
+
+// open opens the file for appending
+func (f *FileStorage) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.out = &lineCounter{w: file}
+	f.enc = json.NewEncoder(f.out)
+	return nil
+}
+
+// compact rewrites the file once the appended lines outnumber the ones the last rewrite left:
+// the clicks and the counters of the A/B and rotation links add a line per redirect.
+// Caller must hold f.mu.
+func (f *FileStorage) compact() {
+	if f.out.lines <= max(compactMinLines, f.compacted) {
+		return
+	}
+	if err := f.rewrite(); err != nil {
+		log.Printf("file storage %s: compaction: %s", f.path, err) // tried again on the next write
+	}
+}
+
+// rewrite replaces the file with the current records only.
+// Caller must hold f.mu.
+func (f *FileStorage) rewrite() error {
+	list, err := f.mem.List(context.Background())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	out := &lineCounter{w: tmp}
+	enc := json.NewEncoder(out)
+	for _, rec := range list {
+		history, err := f.mem.History(context.Background(), rec.ShortURL)
+		if err == nil {
+			err = enc.Encode(fileLine{URLRecord: rec, History: history})
+		}
+		var clicks map[int]int64
+		if err == nil {
+			clicks, err = f.mem.VariantClicks(context.Background(), rec.ShortURL)
+		}
+		if err == nil && len(clicks) > 0 {
+			err = enc.Encode(clicksLine{VariantClicks: variantClicks{ShortURL: rec.ShortURL, Clicks: clicks}})
+		}
+		if rotated := f.mem.rotated(rec.ShortURL); err == nil && rotated > 0 {
+			err = enc.Encode(cursorLine{Cursor: rotationCursor{ShortURL: rec.ShortURL, Rotated: rotated}})
+		}
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	f.mem.tplMu.RLock()
+	for _, templates := range f.mem.templates {
+		for _, tpl := range templates {
+			if err := enc.Encode(templateLine{Template: tpl}); err != nil {
+				f.mem.tplMu.RUnlock()
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	f.mem.tplMu.RUnlock()
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return err
+	}
+	f.compacted = out.lines
+	return f.open()
+}
+
+func (f *FileStorage) Save(ctx context.Context, rec models.URLRecord) error {
+	if rec.UUID == "" {
+		rec.UUID = uuid.NewString()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.compact()
+	if err := f.mem.Save(ctx, rec); err != nil {
+		return err
+	}
+	if err := f.enc.Encode(rec); err != nil {
+		f.mem.Delete(ctx, rec.ShortURL) // keep memory in line with the file
+		return err
+	}
+	return nil
+}
+
+func (f *FileStorage) SaveBatch(ctx context.Context, recs []models.URLRecord) error {
+	// encode the whole batch first, it is written with a single call
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	withUUID := make([]models.URLRecord, len(recs))
+	for i, rec := range recs {
+		if rec.UUID == "" {
+			rec.UUID = uuid.NewString()
+		}
+		withUUID[i] = rec
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.mem.SaveBatch(ctx, withUUID); err != nil {
+		return err
+	}
+	info, err := f.file.Stat()
+	if err == nil {
+		_, err = f.out.Write(buf.Bytes())
+	}
+	if err != nil {
+		// roll back: memory and the tail of the file
+		for _, rec := range withUUID {
+			f.mem.Delete(ctx, rec.ShortURL)
+		}
+		if info != nil {
+			f.file.Truncate(info.Size())
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FileStorage) Get(ctx context.Context, shortURL string) (models.URLRecord, error) {
+	return f.mem.Get(ctx, shortURL)
+}
+
+func (f *FileStorage) UseClick(ctx context.Context, shortURL string) (models.URLRecord, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.compact()
+	before, err := f.mem.Get(ctx, shortURL)
+	if err != nil || before.ClicksLeft == nil {
+		return before, err
+	}
+	rec, err := f.mem.UseClick(ctx, shortURL)
+	if err != nil {
+		return rec, err
+	}
+	return rec, f.enc.Encode(rec)
+}
+
+func (f *FileStorage) ReleaseOriginalURL(ctx context.Context, shortURL string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.compact()
+	rec, err := f.mem.release(shortURL)
+	if err != nil {
+		return err
+	}
+	return f.enc.Encode(rec)
+}
+
+func (f *FileStorage) GetByOriginal(ctx context.Context, originalURL string) (models.URLRecord, error) {
+	return f.mem.GetByOriginal(ctx, originalURL)
+}
+
+func (f *FileStorage) Delete(ctx context.Context, shortURL string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.mem.Delete(ctx, shortURL); err != nil {
+		return err
+	}
+	return f.rewrite()
+}
+
+func (f *FileStorage) DeleteUserURLs(ctx context.Context, userID string, shortURLs []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.compact()
+	deleted, err := f.mem.deleteUserURLs(userID, shortURLs)
+	if err != nil {
+		return err
+	}
+	// the deleted records are appended, they win over the earlier lines on replay
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, rec := range deleted {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	_, err = f.out.Write(buf.Bytes())
+	return err
+}
+
+func (f *FileStorage) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deleted, err := f.mem.DeleteExpired(ctx, now)
+	if err != nil || deleted == 0 {
+		return deleted, err
+	}
+	return deleted, f.rewrite()
+}
+
+func (f *FileStorage) UpdateOriginalURL(_ context.Context, userID, shortURL, originalURL string) (models.URLRecord, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.compact()
+	rec, history, err := f.mem.updateOriginalURL(userID, shortURL, originalURL, time.Now())
+	if err != nil {
+		return models.URLRecord{}, err
+	}
+	return rec, f.enc.Encode(fileLine{URLRecord: rec, History: history})
+}
+
+func (f *FileStorage) History(ctx context.Context, shortURL string) ([]models.URLRevision, error) {
+	return f.mem.History(ctx, shortURL)
+}
+
+func (f *FileStorage) AddVariantClick(ctx context.Context, shortURL string, variant int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.compact()
+	if err := f.mem.AddVariantClick(ctx, shortURL, variant); err != nil {
+		return err
+	}
+	return f.enc.Encode(clicksLine{VariantClicks: variantClicks{ShortURL: shortURL, Clicks: map[int]int64{variant: 1}}})
+}
+
+func (f *FileStorage) VariantClicks(ctx context.Context, shortURL string) (map[int]int64, error) {
+	return f.mem.VariantClicks(ctx, shortURL)
+}
+
+func (f *FileStorage) NextRotation(ctx context.Context, shortURL string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.compact()
+	n, err := f.mem.NextRotation(ctx, shortURL)
+	if err != nil {
+		return 0, err
+	}
+	if err = f.enc.Encode(cursorLine{Cursor: rotationCursor{ShortURL: shortURL, Rotated: n + 1}}); err != nil {
+		f.mem.setRotated(shortURL, n) // keep memory in line with the file
+		return 0, err
+	}
+	return n, nil
+}
+
+func (f *FileStorage) SaveUTMTemplate(ctx context.Context, tpl models.UTMTemplate) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.compact()
+	if err := f.mem.SaveUTMTemplate(ctx, tpl); err != nil {
+		return err
+	}
+	if err := f.enc.Encode(templateLine{Template: tpl}); err != nil {
+		f.mem.tplMu.Lock()
+		delete(f.mem.templates[tpl.UserID], tpl.Name) // keep memory in line with the file
+		f.mem.tplMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (f *FileStorage) GetUTMTemplate(ctx context.Context, userID, name string) (models.UTMTemplate, error) {
+	return f.mem.GetUTMTemplate(ctx, userID, name)
+}
+
+func (f *FileStorage) ListUTMTemplates(ctx context.Context, userID string) ([]models.UTMTemplate, error) {
+	return f.mem.ListUTMTemplates(ctx, userID)
+}
+
+func (f *FileStorage) List(ctx context.Context) ([]models.URLRecord, error) {
+	return f.mem.List(ctx)
+}
+
+func (f *FileStorage) ListWithFallback(ctx context.Context, now time.Time) ([]models.URLRecord, error) {
+	return f.mem.ListWithFallback(ctx, now)
+}
+
+func (f *FileStorage) ListByUser(ctx context.Context, userID string, after string, limit int) ([]models.URLRecord, error) {
+	return f.mem.ListByUser(ctx, userID, after, limit)
+}
+
+func (f *FileStorage) Ping(_ context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.file.Stat()
+	return err
+}
+
+func (f *FileStorage) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
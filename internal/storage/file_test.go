@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/absurd678/skill/internal/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorage(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "short-url-db.json")
+
+	st, err := NewFileStorage(path)
+	require.NoError(t, err)
+	require.NoError(t, st.Ping(ctx))
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "sharaga", OriginalURL: "https://mai.ru"}))
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "prac", OriginalURL: "https://practicum.net", UserID: "user-1"}))
+	require.ErrorIs(t, st.Save(ctx, models.URLRecord{ShortURL: "prac", OriginalURL: "https://ya.ru"}), ErrShortURLExists)
+	require.NoError(t, st.Close())
+
+	// every line is a record with uuid, short_url and original_url
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	scanner := bufio.NewScanner(file)
+	lines := 0
+	for scanner.Scan() {
+		var rec models.URLRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+		require.NotEmpty(t, rec.UUID)
+		require.NotEmpty(t, rec.ShortURL)
+		require.NotEmpty(t, rec.OriginalURL)
+		lines++
+	}
+	file.Close()
+	require.Equal(t, 2, lines)
+
+	// restart: the records are replayed
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	rec, err := st.Get(ctx, "prac")
+	require.NoError(t, err)
+	require.Equal(t, "https://practicum.net", rec.OriginalURL)
+	require.Equal(t, "user-1", rec.UserID)
+	// with the reverse index
+	rec, err = st.GetByOriginal(ctx, "https://practicum.net")
+	require.NoError(t, err)
+	require.Equal(t, "prac", rec.ShortURL)
+	require.ErrorIs(t, st.Save(ctx, models.URLRecord{ShortURL: "other", OriginalURL: "https://mai.ru"}), ErrOriginalURLExists)
+
+	// a batch goes in as a whole
+	require.NoError(t, st.SaveBatch(ctx, []models.URLRecord{
+		{ShortURL: "a", OriginalURL: "https://a.ru"},
+		{ShortURL: "b", OriginalURL: "https://b.ru"},
+	}))
+	require.ErrorIs(t, st.SaveBatch(ctx, []models.URLRecord{
+		{ShortURL: "c", OriginalURL: "https://c.ru"},
+		{ShortURL: "a", OriginalURL: "https://d.ru"},
+	}), ErrShortURLExists)
+
+	// delete survives a restart too
+	require.NoError(t, st.Delete(ctx, "prac"))
+	require.NoError(t, st.Close())
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	defer st.Close()
+	_, err = st.Get(ctx, "prac")
+	require.ErrorIs(t, err, ErrNotFound)
+	list, err := st.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 3) // sharaga, a and b
+	_, err = st.Get(ctx, "c")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestFileStorageBrokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "short-url-db.json")
+	require.NoError(t, os.WriteFile(path, []byte("{not json\n"), 0644))
+	_, err := NewFileStorage(path)
+	require.Error(t, err)
+}
+
+func TestFileStorageLongLine(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "short-url-db.json")
+	long := "https://long.ru/" + strings.Repeat("x", 2<<20)
+	st, err := NewFileStorage(path)
+	require.NoError(t, err)
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "long", OriginalURL: long}))
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "short", OriginalURL: "https://short.ru"}))
+	require.NoError(t, st.Close())
+
+	// a line longer than any buffer is read back all the same
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	defer st.Close()
+	rec, err := st.Get(ctx, "long")
+	require.NoError(t, err)
+	require.Equal(t, long, rec.OriginalURL)
+	_, err = st.Get(ctx, "short")
+	require.NoError(t, err)
+}
+
+func TestFileStorageListByUser(t *testing.T) {
+	st, err := NewFileStorage(filepath.Join(t.TempDir(), "short-url-db.json"))
+	require.NoError(t, err)
+	defer st.Close()
+	checkListByUser(t, st)
+}
+
+func TestFileStorageDeleteUserURLs(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "short-url-db.json")
+	st, err := NewFileStorage(path)
+	require.NoError(t, err)
+	checkDeleteUserURLs(t, st)
+	require.NoError(t, st.Close())
+
+	// the deleted flag survives a restart
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	defer st.Close()
+	rec, err := st.Get(ctx, "a")
+	require.NoError(t, err)
+	require.True(t, rec.DeletedFlag)
+	rec, err = st.GetByOriginal(ctx, "https://a.ru")
+	require.NoError(t, err)
+	require.Equal(t, "a2", rec.ShortURL)
+}
+
+func TestFileStorageUpdateOriginalURL(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "short-url-db.json")
+	st, err := NewFileStorage(path)
+	require.NoError(t, err)
+	checkUpdateOriginalURL(t, st)
+	// a deletion line and a rewrite keep the history
+	require.NoError(t, st.DeleteUserURLs(ctx, "user-1", []string{"a"}))
+	require.NoError(t, st.Delete(ctx, "b"))
+	require.NoError(t, st.Close())
+
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	defer st.Close()
+	rec, err := st.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, "https://a.ru/v2", rec.OriginalURL)
+	require.True(t, rec.DeletedFlag)
+	history, err := st.History(ctx, "a")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+}
+
+func TestFileStorageDeleteExpired(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "short-url-db.json")
+	st, err := NewFileStorage(path)
+	require.NoError(t, err)
+	checkDeleteExpired(t, st)
+	require.NoError(t, st.Close())
+
+	// the purge is in the file too
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	defer st.Close()
+	list, err := st.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+}
+
+func TestFileStorageUseClick(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "short-url-db.json")
+	st, err := NewFileStorage(path)
+	require.NoError(t, err)
+	checkUseClick(t, st)
+	require.NoError(t, st.Close())
+
+	// the spent clicks survive a restart
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	defer st.Close()
+	_, err = st.UseClick(ctx, "limited")
+	require.ErrorIs(t, err, ErrNoClicksLeft)
+}
+
+func TestFileStorageRecordFields(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "short-url-db.json")
+	st, err := NewFileStorage(path)
+	require.NoError(t, err)
+	checkRecordFields(t, st)
+	want, err := st.Get(ctx, "full")
+	require.NoError(t, err)
+	require.NoError(t, st.Close())
+
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	defer st.Close()
+	got, err := st.Get(ctx, "full")
+	require.NoError(t, err)
+	require.Equal(t, want.PasswordHash, got.PasswordHash)
+	require.Equal(t, *want.ClicksLeft, *got.ClicksLeft)
+}
+
+func TestFileStorageUTMTemplates(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "short-url-db.json")
+	st, err := NewFileStorage(path)
+	require.NoError(t, err)
+	checkUTMTemplates(t, st)
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "a", OriginalURL: "https://a.ru"}))
+	require.NoError(t, st.Delete(ctx, "a")) // the rewrite keeps the templates
+	require.NoError(t, st.Close())
+
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	defer st.Close()
+	list, err := st.ListUTMTemplates(ctx, "u1")
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	tpl, err := st.GetUTMTemplate(ctx, "u2", "spring")
+	require.NoError(t, err)
+	require.Equal(t, "vk", tpl.Source)
+}
+
+func TestFileStorageNextRotation(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "short-url-db.json")
+	st, err := NewFileStorage(path)
+	require.NoError(t, err)
+	checkNextRotation(t, st)
+	require.NoError(t, st.Close())
+
+	// the cursor is where it was after a restart and survives a rewrite
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	n, err := st.NextRotation(ctx, "mirrors")
+	require.NoError(t, err)
+	require.Equal(t, int64(51), n)
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "tmp", OriginalURL: "https://tmp.ru"}))
+	require.NoError(t, st.Delete(ctx, "tmp"))
+	require.NoError(t, st.Close())
+
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	defer st.Close()
+	n, err = st.NextRotation(ctx, "mirrors")
+	require.NoError(t, err)
+	require.Equal(t, int64(52), n)
+}
+
+func TestFileStorageReleaseOriginalURL(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "short-url-db.json")
+	st, err := NewFileStorage(path)
+	require.NoError(t, err)
+	checkReleaseOriginalURL(t, st)
+	require.NoError(t, st.ReleaseOriginalURL(ctx, "old"))
+	require.NoError(t, st.Close())
+
+	// the released record doesn't take its URL back after a restart
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	defer st.Close()
+	rec, err := st.GetByOriginal(ctx, "https://gift.ru")
+	require.NoError(t, err)
+	require.Equal(t, "new", rec.ShortURL)
+	rec, err = st.Get(ctx, "old")
+	require.NoError(t, err)
+	require.True(t, rec.Released)
+	_, err = st.GetByOriginal(ctx, "https://gift.ru/v2")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestFileStorageListWithFallback(t *testing.T) {
+	st, err := NewFileStorage(filepath.Join(t.TempDir(), "short-url-db.json"))
+	require.NoError(t, err)
+	defer st.Close()
+	checkListWithFallback(t, st)
+}
+
+func TestFileStorageVariantClicks(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "short-url-db.json")
+	st, err := NewFileStorage(path)
+	require.NoError(t, err)
+	checkVariantClicks(t, st)
+	require.NoError(t, st.AddVariantClick(ctx, "ab", 0))
+	require.NoError(t, st.AddVariantClick(ctx, "ab", 0))
+	require.NoError(t, st.Close())
+
+	// the clicks are added up on replay and survive a rewrite
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	clicks, err := st.VariantClicks(ctx, "ab")
+	require.NoError(t, err)
+	require.Equal(t, map[int]int64{0: 2}, clicks)
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "tmp", OriginalURL: "https://tmp.ru"}))
+	require.NoError(t, st.Delete(ctx, "tmp"))
+	require.NoError(t, st.Close())
+
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	defer st.Close()
+	clicks, err = st.VariantClicks(ctx, "ab")
+	require.NoError(t, err)
+	require.Equal(t, map[int]int64{0: 2}, clicks)
+}
+
+func TestFileStorageCompaction(t *testing.T) {
+	defer func(n int) { compactMinLines = n }(compactMinLines)
+	compactMinLines = 20
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "short-url-db.json")
+	st, err := NewFileStorage(path)
+	require.NoError(t, err)
+	require.NoError(t, st.Save(ctx, models.URLRecord{
+		ShortURL: "ab", OriginalURL: "https://ab.ru",
+		Variants: []models.Variant{{URL: "https://a.ru", Weight: 1}, {URL: "https://b.ru", Weight: 1}},
+	}))
+	require.NoError(t, st.Save(ctx, models.URLRecord{
+		ShortURL: "mirrors", OriginalURL: "https://mirrors.ru", Rotation: []string{"https://m1.ru", "https://m2.ru"},
+	}))
+	for i := 0; i < 500; i++ {
+		require.NoError(t, st.AddVariantClick(ctx, "ab", i%2))
+		_, err := st.NextRotation(ctx, "mirrors")
+		require.NoError(t, err)
+	}
+	require.NoError(t, st.Close())
+
+	// a line per redirect is not kept forever
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.LessOrEqual(t, bytes.Count(data, []byte{'\n'}), 2*compactMinLines)
+
+	st, err = NewFileStorage(path)
+	require.NoError(t, err)
+	defer st.Close()
+	clicks, err := st.VariantClicks(ctx, "ab")
+	require.NoError(t, err)
+	require.Equal(t, map[int]int64{0: 250, 1: 250}, clicks)
+	n, err := st.NextRotation(ctx, "mirrors")
+	require.NoError(t, err)
+	require.Equal(t, int64(500), n)
+}
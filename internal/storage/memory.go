@@ -0,0 +1,634 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/absurd678/skill/internal/models"
+	"github.com/google/uuid"
+)
+
+const memoryShards = 32 // number of independently locked parts of the map
+
+// memoryShard is a part of the short URL -> record map guarded by its own lock
+type memoryShard struct {
+	mu      sync.RWMutex
+	records map[string]models.URLRecord
+	history map[string][]models.URLRevision // previous destinations by short URL
+	clicks  map[string]map[int]int64        // redirects to the A/B variants by short URL
+	rotated map[string]int64                // redirects made by the rotation by short URL
+}
+
+// reverseShard is a part of the original URL -> short URL index
+type reverseShard struct {
+	mu        sync.RWMutex
+	shortURLs map[string]string
+}
+
+// userShard is a part of the user ID -> set of short URLs index
+type userShard struct {
+	mu        sync.RWMutex
+	shortURLs map[string]map[string]bool
+}
+
+// MemoryStorage keeps the records in a sharded map, everything is lost on restart.
+// Each short URL belongs to one shard, so parallel requests for different
+// links rarely wait for the same lock. The indexes by original URL and by user
+// are sharded the same way; the locks are always taken in the order
+// records -> reverse -> users.
+type MemoryStorage struct {
+	shards  [memoryShards]*memoryShard
+	reverse [memoryShards]*reverseShard
+	users   [memoryShards]*userShard
+
+	tplMu     sync.RWMutex                             // UTM templates are few, one lock is enough
+	templates map[string]map[string]models.UTMTemplate // user ID -> name -> template
+}
+
+// NewMemoryStorage creates the storage filled with a copy of init (may be nil)
+func NewMemoryStorage(init map[string]string) *MemoryStorage {
+	m := &MemoryStorage{templates: make(map[string]map[string]models.UTMTemplate)}
+	for i := range m.shards {
+		m.shards[i] = &memoryShard{
+			records: make(map[string]models.URLRecord),
+			history: make(map[string][]models.URLRevision),
+			clicks:  make(map[string]map[int]int64),
+			rotated: make(map[string]int64),
+		}
+		m.reverse[i] = &reverseShard{shortURLs: make(map[string]string)}
+		m.users[i] = &userShard{shortURLs: make(map[string]map[string]bool)}
+	}
+	for short, original := range init {
+		m.set(models.URLRecord{UUID: uuid.NewString(), ShortURL: short, OriginalURL: original})
+	}
+	return m
+}
+
+// shardIndex picks the shard number for the key
+func shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % memoryShards)
+}
+
+// shardIndexes returns the unique shard numbers of the keys in ascending order
+// (the order of locking, so two writers can't deadlock)
+func shardIndexes(keys []string) []int {
+	seen := map[int]bool{}
+	var idx []int
+	for _, key := range keys {
+		if i := shardIndex(key); !seen[i] {
+			seen[i] = true
+			idx = append(idx, i)
+		}
+	}
+	sort.Ints(idx)
+	return idx
+}
+
+// shard picks the shard for the short URL
+func (m *MemoryStorage) shard(shortURL string) *memoryShard {
+	return m.shards[shardIndex(shortURL)]
+}
+
+// reverseShard picks the reverse index shard for the original URL
+func (m *MemoryStorage) reverseShard(originalURL string) *reverseShard {
+	return m.reverse[shardIndex(originalURL)]
+}
+
+// userShard picks the user index shard for the user ID
+func (m *MemoryStorage) userShard(userID string) *userShard {
+	return m.users[shardIndex(userID)]
+}
+
+// lockShards write-locks the record shards of the short URLs and returns the unlocking function
+func (m *MemoryStorage) lockShards(shortURLs []string) func() {
+	idx := shardIndexes(shortURLs)
+	for _, i := range idx {
+		m.shards[i].mu.Lock()
+	}
+	return func() {
+		for _, i := range idx {
+			m.shards[i].mu.Unlock()
+		}
+	}
+}
+
+// lockReverse write-locks the reverse index shards of the original URLs and returns the unlocking function.
+// Must be called after lockShards when both are needed.
+func (m *MemoryStorage) lockReverse(originalURLs []string) func() {
+	idx := shardIndexes(originalURLs)
+	for _, i := range idx {
+		m.reverse[i].mu.Lock()
+	}
+	return func() {
+		for _, i := range idx {
+			m.reverse[i].mu.Unlock()
+		}
+	}
+}
+
+// lockUsers write-locks the user index shards of the user IDs and returns the unlocking function.
+// Must be called after lockShards and lockReverse when they are needed.
+func (m *MemoryStorage) lockUsers(userIDs []string) func() {
+	idx := shardIndexes(userIDs)
+	for _, i := range idx {
+		m.users[i].mu.Lock()
+	}
+	return func() {
+		for _, i := range idx {
+			m.users[i].mu.Unlock()
+		}
+	}
+}
+
+// lockIndexes write-locks the index shards of the records (after their own shards)
+func (m *MemoryStorage) lockIndexes(recs ...models.URLRecord) func() {
+	originalURLs := make([]string, len(recs))
+	userIDs := make([]string, len(recs))
+	for i := range recs {
+		originalURLs[i] = recs[i].OriginalURL
+		userIDs[i] = recs[i].UserID
+	}
+	unlockReverse := m.lockReverse(originalURLs)
+	unlockUsers := m.lockUsers(userIDs)
+	return func() {
+		unlockUsers()
+		unlockReverse()
+	}
+}
+
+// set adds or replaces the record without any checks (used for replaying)
+func (m *MemoryStorage) set(rec models.URLRecord) {
+	unlock := m.lockShards([]string{rec.ShortURL})
+	defer unlock()
+	old, replaced := m.shard(rec.ShortURL).records[rec.ShortURL]
+	unlockIndexes := m.lockIndexes(old, rec)
+	defer unlockIndexes()
+
+	if replaced {
+		m.removeIndexes(old)
+	}
+	m.shard(rec.ShortURL).records[rec.ShortURL] = rec
+	m.addIndexes(rec)
+}
+
+// addIndexes puts the record into the reverse (unless released) and user indexes (unless deleted).
+// Caller must hold the index shard locks.
+func (m *MemoryStorage) addIndexes(rec models.URLRecord) {
+	if rec.DeletedFlag {
+		return
+	}
+	if !rec.Released {
+		m.reverseShard(rec.OriginalURL).shortURLs[rec.OriginalURL] = rec.ShortURL
+	}
+	if rec.UserID == "" {
+		return
+	}
+	ush := m.userShard(rec.UserID)
+	if ush.shortURLs[rec.UserID] == nil {
+		ush.shortURLs[rec.UserID] = map[string]bool{}
+	}
+	ush.shortURLs[rec.UserID][rec.ShortURL] = true
+}
+
+// removeIndexes drops the index entries of the record (the reverse one only if it still points to the record).
+// Caller must hold the index shard locks.
+func (m *MemoryStorage) removeIndexes(rec models.URLRecord) {
+	rsh := m.reverseShard(rec.OriginalURL)
+	if rsh.shortURLs[rec.OriginalURL] == rec.ShortURL {
+		delete(rsh.shortURLs, rec.OriginalURL)
+	}
+	if rec.UserID == "" {
+		return
+	}
+	ush := m.userShard(rec.UserID)
+	delete(ush.shortURLs[rec.UserID], rec.ShortURL)
+	if len(ush.shortURLs[rec.UserID]) == 0 {
+		delete(ush.shortURLs, rec.UserID)
+	}
+}
+
+func (m *MemoryStorage) Save(ctx context.Context, rec models.URLRecord) error {
+	return m.SaveBatch(ctx, []models.URLRecord{rec})
+}
+
+func (m *MemoryStorage) SaveBatch(_ context.Context, recs []models.URLRecord) error {
+	shortURLs := make([]string, len(recs))
+	for i := range recs {
+		shortURLs[i] = recs[i].ShortURL
+	}
+	unlock := m.lockShards(shortURLs)
+	defer unlock()
+	unlockIndexes := m.lockIndexes(recs...)
+	defer unlockIndexes()
+
+	// check everything first so the batch goes in as a whole
+	shortInBatch := make(map[string]bool, len(recs))
+	originalInBatch := make(map[string]bool, len(recs))
+	for _, rec := range recs {
+		if _, ok := m.shard(rec.ShortURL).records[rec.ShortURL]; ok || shortInBatch[rec.ShortURL] {
+			return ErrShortURLExists
+		}
+		if _, ok := m.reverseShard(rec.OriginalURL).shortURLs[rec.OriginalURL]; ok || originalInBatch[rec.OriginalURL] {
+			return ErrOriginalURLExists
+		}
+		shortInBatch[rec.ShortURL] = true
+		originalInBatch[rec.OriginalURL] = true
+	}
+	for _, rec := range recs {
+		if rec.UUID == "" {
+			rec.UUID = uuid.NewString()
+		}
+		m.shard(rec.ShortURL).records[rec.ShortURL] = rec
+		m.addIndexes(rec)
+	}
+	return nil
+}
+
+func (m *MemoryStorage) Get(_ context.Context, shortURL string) (models.URLRecord, error) {
+	sh := m.shard(shortURL)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	rec, ok := sh.records[shortURL]
+	if !ok {
+		return models.URLRecord{}, ErrNotFound
+	}
+	return rec, nil
+}
+
+func (m *MemoryStorage) UseClick(_ context.Context, shortURL string) (models.URLRecord, error) {
+	sh := m.shard(shortURL)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	rec, ok := sh.records[shortURL]
+	if !ok {
+		return models.URLRecord{}, ErrNotFound
+	}
+	if rec.ClicksLeft == nil {
+		return rec, nil
+	}
+	if *rec.ClicksLeft <= 0 {
+		return rec, ErrNoClicksLeft
+	}
+	left := *rec.ClicksLeft - 1 // a new value, the old pointer may be held by readers
+	rec.ClicksLeft = &left
+	sh.records[shortURL] = rec
+	return rec, nil
+}
+
+func (m *MemoryStorage) GetByOriginal(ctx context.Context, originalURL string) (models.URLRecord, error) {
+	rsh := m.reverseShard(originalURL)
+	rsh.mu.RLock()
+	shortURL, ok := rsh.shortURLs[originalURL]
+	rsh.mu.RUnlock()
+	if !ok {
+		return models.URLRecord{}, ErrNotFound
+	}
+	return m.Get(ctx, shortURL)
+}
+
+func (m *MemoryStorage) ReleaseOriginalURL(_ context.Context, shortURL string) error {
+	_, err := m.release(shortURL)
+	return err
+}
+
+// release marks the record released and returns it
+func (m *MemoryStorage) release(shortURL string) (models.URLRecord, error) {
+	unlock := m.lockShards([]string{shortURL})
+	defer unlock()
+	sh := m.shard(shortURL)
+	rec, ok := sh.records[shortURL]
+	if !ok || rec.DeletedFlag || rec.Released {
+		return models.URLRecord{}, ErrNotFound
+	}
+	unlockIndexes := m.lockIndexes(rec)
+	defer unlockIndexes()
+	m.removeIndexes(rec)
+	rec.Released = true
+	sh.records[shortURL] = rec
+	m.addIndexes(rec)
+	return rec, nil
+}
+
+func (m *MemoryStorage) Delete(_ context.Context, shortURL string) error {
+	return m.deleteIf(shortURL, func(models.URLRecord) bool { return true })
+}
+
+// deleteIf removes the record if it passes the check, otherwise returns ErrNotFound
+func (m *MemoryStorage) deleteIf(shortURL string, check func(models.URLRecord) bool) error {
+	unlock := m.lockShards([]string{shortURL})
+	defer unlock()
+	sh := m.shard(shortURL)
+	rec, ok := sh.records[shortURL]
+	if !ok || !check(rec) {
+		return ErrNotFound
+	}
+	unlockIndexes := m.lockIndexes(rec)
+	defer unlockIndexes()
+	delete(sh.records, shortURL)
+	delete(sh.history, shortURL)
+	delete(sh.clicks, shortURL)
+	delete(sh.rotated, shortURL)
+	m.removeIndexes(rec)
+	return nil
+}
+
+func (m *MemoryStorage) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	var expired []string
+	for _, sh := range m.shards {
+		sh.mu.RLock()
+		for short, rec := range sh.records {
+			if rec.Expired(now) {
+				expired = append(expired, short)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+
+	deleted := 0
+	for _, short := range expired {
+		err := m.deleteIf(short, func(rec models.URLRecord) bool { return rec.Expired(now) })
+		if errors.Is(err, ErrNotFound) {
+			continue // gone or changed in between
+		}
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (m *MemoryStorage) UpdateOriginalURL(_ context.Context, userID, shortURL, originalURL string) (models.URLRecord, error) {
+	rec, _, err := m.updateOriginalURL(userID, shortURL, originalURL, time.Now())
+	return rec, err
+}
+
+// updateOriginalURL changes the destination and returns the record with its whole history
+func (m *MemoryStorage) updateOriginalURL(userID, shortURL, originalURL string, now time.Time) (models.URLRecord, []models.URLRevision, error) {
+	unlock := m.lockShards([]string{shortURL})
+	defer unlock()
+	sh := m.shard(shortURL)
+	old, ok := sh.records[shortURL]
+	if !ok || old.UserID != userID || old.DeletedFlag {
+		return models.URLRecord{}, nil, ErrNotFound
+	}
+	if old.OriginalURL == originalURL {
+		return old, sh.history[shortURL], nil // nothing changes
+	}
+
+	rec := old
+	rec.OriginalURL = originalURL
+	rec.Released = false
+	unlockIndexes := m.lockIndexes(old, rec)
+	defer unlockIndexes()
+	if _, ok := m.reverseShard(originalURL).shortURLs[originalURL]; ok {
+		return models.URLRecord{}, nil, ErrOriginalURLExists
+	}
+
+	m.removeIndexes(old)
+	sh.records[shortURL] = rec
+	m.addIndexes(rec)
+	sh.history[shortURL] = append(sh.history[shortURL], models.URLRevision{
+		Revision:    len(sh.history[shortURL]) + 1,
+		OriginalURL: old.OriginalURL,
+		ChangedAt:   now.UTC(),
+	})
+	return rec, sh.history[shortURL], nil
+}
+
+// setHistory replaces the history of the short URL (used for replaying)
+func (m *MemoryStorage) setHistory(shortURL string, history []models.URLRevision) {
+	sh := m.shard(shortURL)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if len(history) == 0 {
+		delete(sh.history, shortURL)
+		return
+	}
+	sh.history[shortURL] = history
+}
+
+func (m *MemoryStorage) History(_ context.Context, shortURL string) ([]models.URLRevision, error) {
+	sh := m.shard(shortURL)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	if _, ok := sh.records[shortURL]; !ok {
+		return nil, ErrNotFound
+	}
+	return append([]models.URLRevision(nil), sh.history[shortURL]...), nil
+}
+
+func (m *MemoryStorage) DeleteUserURLs(ctx context.Context, userID string, shortURLs []string) error {
+	_, err := m.deleteUserURLs(userID, shortURLs)
+	return err
+}
+
+// deleteUserURLs marks the records deleted and returns the ones that have changed
+func (m *MemoryStorage) deleteUserURLs(userID string, shortURLs []string) ([]models.URLRecord, error) {
+	unlock := m.lockShards(shortURLs)
+	defer unlock()
+
+	var deleted []models.URLRecord
+	for _, short := range shortURLs {
+		rec, ok := m.shard(short).records[short]
+		if !ok || rec.UserID != userID || rec.DeletedFlag {
+			continue
+		}
+		deleted = append(deleted, rec)
+	}
+	unlockIndexes := m.lockIndexes(deleted...)
+	defer unlockIndexes()
+
+	for i := range deleted {
+		m.removeIndexes(deleted[i])
+		deleted[i].DeletedFlag = true
+		m.shard(deleted[i].ShortURL).records[deleted[i].ShortURL] = deleted[i]
+	}
+	return deleted, nil
+}
+
+func (m *MemoryStorage) List(_ context.Context) ([]models.URLRecord, error) {
+	var list []models.URLRecord
+	for _, sh := range m.shards {
+		sh.mu.RLock()
+		for _, rec := range sh.records {
+			list = append(list, rec)
+		}
+		sh.mu.RUnlock()
+	}
+	return list, nil
+}
+
+func (m *MemoryStorage) ListWithFallback(_ context.Context, now time.Time) ([]models.URLRecord, error) {
+	var list []models.URLRecord
+	for _, sh := range m.shards {
+		sh.mu.RLock()
+		for _, rec := range sh.records {
+			if rec.FallbackURL != "" && !rec.DeletedFlag && !rec.Released && !rec.Expired(now) {
+				list = append(list, rec)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return list, nil
+}
+
+func (m *MemoryStorage) ListByUser(ctx context.Context, userID string, after string, limit int) ([]models.URLRecord, error) {
+	ush := m.userShard(userID)
+	ush.mu.RLock()
+	shortURLs := make([]string, 0, len(ush.shortURLs[userID]))
+	for short := range ush.shortURLs[userID] {
+		if short > after {
+			shortURLs = append(shortURLs, short)
+		}
+	}
+	ush.mu.RUnlock()
+	sort.Strings(shortURLs)
+
+	list := make([]models.URLRecord, 0, min(limit, len(shortURLs)))
+	for _, short := range shortURLs {
+		if len(list) == limit {
+			break
+		}
+		rec, err := m.Get(ctx, short)
+		if errors.Is(err, ErrNotFound) {
+			continue // deleted in between
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, rec)
+	}
+	return list, nil
+}
+
+func (m *MemoryStorage) AddVariantClick(_ context.Context, shortURL string, variant int) error {
+	sh := m.shard(shortURL)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.records[shortURL]; !ok {
+		return ErrNotFound
+	}
+	m.addClicks(sh, shortURL, variant, 1)
+	return nil
+}
+
+// addClicks adds n redirects to the variant. Caller must hold the shard lock.
+func (m *MemoryStorage) addClicks(sh *memoryShard, shortURL string, variant int, n int64) {
+	if sh.clicks[shortURL] == nil {
+		sh.clicks[shortURL] = make(map[int]int64)
+	}
+	sh.clicks[shortURL][variant] += n
+}
+
+// setClicks adds the replayed redirects of the variants
+func (m *MemoryStorage) setClicks(shortURL string, clicks map[int]int64) {
+	sh := m.shard(shortURL)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for variant, n := range clicks {
+		m.addClicks(sh, shortURL, variant, n)
+	}
+}
+
+func (m *MemoryStorage) VariantClicks(_ context.Context, shortURL string) (map[int]int64, error) {
+	sh := m.shard(shortURL)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	if _, ok := sh.records[shortURL]; !ok {
+		return nil, ErrNotFound
+	}
+	clicks := make(map[int]int64, len(sh.clicks[shortURL]))
+	for variant, n := range sh.clicks[shortURL] {
+		clicks[variant] = n
+	}
+	return clicks, nil
+}
+
+func (m *MemoryStorage) NextRotation(_ context.Context, shortURL string) (int64, error) {
+	sh := m.shard(shortURL)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.records[shortURL]; !ok {
+		return 0, ErrNotFound
+	}
+	n := sh.rotated[shortURL]
+	sh.rotated[shortURL] = n + 1
+	return n, nil
+}
+
+// setRotated puts back the replayed (or rolled back) number of redirects made by the rotation
+func (m *MemoryStorage) setRotated(shortURL string, n int64) {
+	sh := m.shard(shortURL)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.rotated[shortURL] = n
+}
+
+// rotated returns the number of redirects made by the rotation of the record, 0 if none
+func (m *MemoryStorage) rotated(shortURL string) int64 {
+	sh := m.shard(shortURL)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.rotated[shortURL]
+}
+
+func (m *MemoryStorage) SaveUTMTemplate(_ context.Context, tpl models.UTMTemplate) error {
+	m.tplMu.Lock()
+	defer m.tplMu.Unlock()
+	if _, ok := m.templates[tpl.UserID][tpl.Name]; ok {
+		return ErrUTMTemplateExists
+	}
+	m.putUTMTemplate(tpl)
+	return nil
+}
+
+// setUTMTemplate adds or replaces the template without any checks (used for replaying)
+func (m *MemoryStorage) setUTMTemplate(tpl models.UTMTemplate) {
+	m.tplMu.Lock()
+	defer m.tplMu.Unlock()
+	m.putUTMTemplate(tpl)
+}
+
+// putUTMTemplate stores the template. Caller must hold m.tplMu.
+func (m *MemoryStorage) putUTMTemplate(tpl models.UTMTemplate) {
+	if m.templates[tpl.UserID] == nil {
+		m.templates[tpl.UserID] = make(map[string]models.UTMTemplate)
+	}
+	m.templates[tpl.UserID][tpl.Name] = tpl
+}
+
+func (m *MemoryStorage) GetUTMTemplate(_ context.Context, userID, name string) (models.UTMTemplate, error) {
+	m.tplMu.RLock()
+	defer m.tplMu.RUnlock()
+	tpl, ok := m.templates[userID][name]
+	if !ok {
+		return models.UTMTemplate{}, ErrNotFound
+	}
+	return tpl, nil
+}
+
+func (m *MemoryStorage) ListUTMTemplates(_ context.Context, userID string) ([]models.UTMTemplate, error) {
+	m.tplMu.RLock()
+	list := make([]models.UTMTemplate, 0, len(m.templates[userID]))
+	for _, tpl := range m.templates[userID] {
+		list = append(list, tpl)
+	}
+	m.tplMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (m *MemoryStorage) Ping(_ context.Context) error {
+	return nil // always reachable
+}
+
+func (m *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,576 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/absurd678/skill/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage(map[string]string{"sharaga": "https://mai.ru"})
+	defer st.Close()
+
+	require.NoError(t, st.Ping(ctx))
+
+	// initial record
+	rec, err := st.Get(ctx, "sharaga")
+	require.NoError(t, err)
+	require.Equal(t, "https://mai.ru", rec.OriginalURL)
+
+	// save and list
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "prac", OriginalURL: "https://practicum.net"}))
+	require.ErrorIs(t, st.Save(ctx, models.URLRecord{ShortURL: "prac", OriginalURL: "https://ya.ru"}), ErrShortURLExists)
+	require.ErrorIs(t, st.Save(ctx, models.URLRecord{ShortURL: "other", OriginalURL: "https://practicum.net"}), ErrOriginalURLExists)
+	rec, err = st.GetByOriginal(ctx, "https://practicum.net")
+	require.NoError(t, err)
+	require.Equal(t, "prac", rec.ShortURL)
+	list, err := st.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+
+	// delete
+	require.NoError(t, st.Delete(ctx, "prac"))
+	_, err = st.Get(ctx, "prac")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.ErrorIs(t, st.Delete(ctx, "prac"), ErrNotFound)
+
+	// the original URL is free again after delete
+	_, err = st.GetByOriginal(ctx, "https://practicum.net")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "other", OriginalURL: "https://practicum.net"}))
+}
+
+// Run with -race: parallel writers and readers must not race
+func TestMemoryStorageParallel(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage(nil)
+
+	const workers, perWorker = 16, 200
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				short := fmt.Sprintf("w%d-%d", w, i)
+				assert.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: short, OriginalURL: "https://" + short}))
+				rec, err := st.Get(ctx, short)
+				assert.NoError(t, err)
+				assert.Equal(t, "https://"+short, rec.OriginalURL)
+				_, _ = st.List(ctx) // readers of the whole map too
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	list, err := st.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, workers*perWorker)
+}
+
+func BenchmarkMemoryStorageSave(b *testing.B) {
+	ctx := context.Background()
+	st := NewMemoryStorage(nil)
+	var n atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			short := strconv.FormatInt(n.Add(1), 36)
+			st.Save(ctx, models.URLRecord{ShortURL: short, OriginalURL: "https://practicum.net/" + short})
+		}
+	})
+}
+
+func BenchmarkMemoryStorageGet(b *testing.B) {
+	ctx := context.Background()
+	st := NewMemoryStorage(nil)
+	const records = 10000
+	for i := 0; i < records; i++ {
+		st.Save(ctx, models.URLRecord{ShortURL: strconv.Itoa(i), OriginalURL: "https://practicum.net/" + strconv.Itoa(i)})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			st.Get(ctx, strconv.Itoa(i%records))
+			i++
+		}
+	})
+}
+
+func TestMemoryStorageSaveBatch(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage(map[string]string{"sharaga": "https://mai.ru"})
+
+	require.NoError(t, st.SaveBatch(ctx, []models.URLRecord{
+		{ShortURL: "a", OriginalURL: "https://a.ru"},
+		{ShortURL: "b", OriginalURL: "https://b.ru"},
+	}))
+
+	// one taken short URL fails the whole batch
+	require.ErrorIs(t, st.SaveBatch(ctx, []models.URLRecord{
+		{ShortURL: "c", OriginalURL: "https://c.ru"},
+		{ShortURL: "sharaga", OriginalURL: "https://d.ru"},
+	}), ErrShortURLExists)
+	// as well as duplicates inside the batch
+	require.ErrorIs(t, st.SaveBatch(ctx, []models.URLRecord{
+		{ShortURL: "e", OriginalURL: "https://e.ru"},
+		{ShortURL: "e", OriginalURL: "https://f.ru"},
+	}), ErrShortURLExists)
+	// and already shortened original URLs
+	require.ErrorIs(t, st.SaveBatch(ctx, []models.URLRecord{
+		{ShortURL: "e", OriginalURL: "https://e.ru"},
+		{ShortURL: "f", OriginalURL: "https://mai.ru"},
+	}), ErrOriginalURLExists)
+
+	_, err := st.Get(ctx, "c")
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = st.Get(ctx, "e")
+	require.ErrorIs(t, err, ErrNotFound)
+	list, err := st.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+}
+
+// checkListByUser pages through the links of one user, the same for every backend
+func checkListByUser(t *testing.T, st Storage) {
+	ctx := context.Background()
+	for _, rec := range []models.URLRecord{
+		{ShortURL: "c", OriginalURL: "https://c.ru", UserID: "user-1"},
+		{ShortURL: "a", OriginalURL: "https://a.ru", UserID: "user-1"},
+		{ShortURL: "b", OriginalURL: "https://b.ru", UserID: "user-2"},
+		{ShortURL: "d", OriginalURL: "https://d.ru", UserID: "user-1"},
+	} {
+		require.NoError(t, st.Save(ctx, rec))
+	}
+
+	page, err := st.ListByUser(ctx, "user-1", "", 2)
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	require.Equal(t, "a", page[0].ShortURL)
+	require.Equal(t, "c", page[1].ShortURL)
+
+	page, err = st.ListByUser(ctx, "user-1", "c", 2)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	require.Equal(t, "d", page[0].ShortURL)
+	require.Equal(t, "https://d.ru", page[0].OriginalURL)
+
+	// deleted links are gone from the list
+	require.NoError(t, st.Delete(ctx, "a"))
+	page, err = st.ListByUser(ctx, "user-1", "", 10)
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+
+	page, err = st.ListByUser(ctx, "nobody", "", 10)
+	require.NoError(t, err)
+	require.Empty(t, page)
+}
+
+func TestMemoryStorageListByUser(t *testing.T) {
+	checkListByUser(t, NewMemoryStorage(nil))
+}
+
+// checkDeleteUserURLs soft-deletes the links of one user, the same for every backend
+func checkDeleteUserURLs(t *testing.T, st Storage) {
+	ctx := context.Background()
+	for _, rec := range []models.URLRecord{
+		{ShortURL: "a", OriginalURL: "https://a.ru", UserID: "user-1"},
+		{ShortURL: "b", OriginalURL: "https://b.ru", UserID: "user-1"},
+		{ShortURL: "c", OriginalURL: "https://c.ru", UserID: "user-2"},
+	} {
+		require.NoError(t, st.Save(ctx, rec))
+	}
+
+	// c is not of user-1 and x doesn't exist: both skipped
+	require.NoError(t, st.DeleteUserURLs(ctx, "user-1", []string{"a", "c", "x"}))
+
+	rec, err := st.Get(ctx, "a")
+	require.NoError(t, err)
+	require.True(t, rec.DeletedFlag)
+	rec, err = st.Get(ctx, "c")
+	require.NoError(t, err)
+	require.False(t, rec.DeletedFlag)
+
+	list, err := st.ListByUser(ctx, "user-1", "", 10)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, "b", list[0].ShortURL)
+
+	// the short URL stays taken, the original URL is free
+	require.ErrorIs(t, st.Save(ctx, models.URLRecord{ShortURL: "a", OriginalURL: "https://new.ru"}), ErrShortURLExists)
+	_, err = st.GetByOriginal(ctx, "https://a.ru")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "a2", OriginalURL: "https://a.ru", UserID: "user-1"}))
+}
+
+func TestMemoryStorageDeleteUserURLs(t *testing.T) {
+	checkDeleteUserURLs(t, NewMemoryStorage(nil))
+}
+
+// checkUpdateOriginalURL changes a destination twice, the same for every backend
+func checkUpdateOriginalURL(t *testing.T, st Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "a", OriginalURL: "https://typo.ru", UserID: "user-1"}))
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "b", OriginalURL: "https://b.ru", UserID: "user-1"}))
+
+	// only the owner can change it
+	_, err := st.UpdateOriginalURL(ctx, "user-2", "a", "https://a.ru")
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = st.UpdateOriginalURL(ctx, "user-1", "x", "https://a.ru")
+	require.ErrorIs(t, err, ErrNotFound)
+	// to a URL nobody has shortened
+	_, err = st.UpdateOriginalURL(ctx, "user-1", "a", "https://b.ru")
+	require.ErrorIs(t, err, ErrOriginalURLExists)
+
+	rec, err := st.UpdateOriginalURL(ctx, "user-1", "a", "https://a.ru")
+	require.NoError(t, err)
+	require.Equal(t, "https://a.ru", rec.OriginalURL)
+	_, err = st.UpdateOriginalURL(ctx, "user-1", "a", "https://a.ru/v2")
+	require.NoError(t, err)
+
+	rec, err = st.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, "https://a.ru/v2", rec.OriginalURL)
+	// the reverse index follows
+	rec, err = st.GetByOriginal(ctx, "https://a.ru/v2")
+	require.NoError(t, err)
+	require.Equal(t, "a", rec.ShortURL)
+	_, err = st.GetByOriginal(ctx, "https://typo.ru")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	history, err := st.History(ctx, "a")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, 1, history[0].Revision)
+	require.Equal(t, "https://typo.ru", history[0].OriginalURL)
+	require.Equal(t, 2, history[1].Revision)
+	require.Equal(t, "https://a.ru", history[1].OriginalURL)
+	require.False(t, history[1].ChangedAt.IsZero())
+
+	history, err = st.History(ctx, "b")
+	require.NoError(t, err)
+	require.Empty(t, history)
+	_, err = st.History(ctx, "x")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryStorageUpdateOriginalURL(t *testing.T) {
+	checkUpdateOriginalURL(t, NewMemoryStorage(nil))
+}
+
+// checkDeleteExpired purges the expired links, the same for every backend
+func checkDeleteExpired(t *testing.T, st Storage) {
+	ctx := context.Background()
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "old", OriginalURL: "https://old.ru", ExpiresAt: &past}))
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "new", OriginalURL: "https://new.ru", ExpiresAt: &future}))
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "forever", OriginalURL: "https://forever.ru"}))
+
+	rec, err := st.Get(ctx, "new")
+	require.NoError(t, err)
+	require.NotNil(t, rec.ExpiresAt)
+	require.True(t, future.Equal(*rec.ExpiresAt))
+	require.False(t, rec.Expired(now))
+
+	deleted, err := st.DeleteExpired(ctx, now)
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+	_, err = st.Get(ctx, "old")
+	require.ErrorIs(t, err, ErrNotFound)
+	// the original URL is free again
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "old2", OriginalURL: "https://old.ru"}))
+
+	deleted, err = st.DeleteExpired(ctx, future.Add(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+	list, err := st.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 2) // forever and old2
+}
+
+func TestMemoryStorageDeleteExpired(t *testing.T) {
+	checkDeleteExpired(t, NewMemoryStorage(nil))
+}
+
+// checkUseClick spends the clicks of a limited link from many goroutines at once,
+// the same for every backend
+func checkUseClick(t *testing.T, st Storage) {
+	ctx := context.Background()
+	const clicks, clickers = 10, 50
+	left := int64(clicks)
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "limited", OriginalURL: "https://limited.ru", ClicksLeft: &left}))
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "free", OriginalURL: "https://free.ru"}))
+
+	var used, exhausted atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < clickers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := st.UseClick(ctx, "limited")
+			switch {
+			case err == nil:
+				used.Add(1)
+			case errors.Is(err, ErrNoClicksLeft):
+				exhausted.Add(1)
+			default:
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	require.EqualValues(t, clicks, used.Load())
+	require.EqualValues(t, clickers-clicks, exhausted.Load())
+
+	rec, err := st.Get(ctx, "limited")
+	require.NoError(t, err)
+	require.NotNil(t, rec.ClicksLeft)
+	require.EqualValues(t, 0, *rec.ClicksLeft)
+	require.True(t, rec.Exhausted())
+
+	// unlimited links are not counted
+	rec, err = st.UseClick(ctx, "free")
+	require.NoError(t, err)
+	require.Nil(t, rec.ClicksLeft)
+	_, err = st.UseClick(ctx, "nope")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryStorageUseClick(t *testing.T) {
+	checkUseClick(t, NewMemoryStorage(nil))
+}
+
+// checkRecordFields saves a record with every optional field set and reads it back,
+// the same for every backend
+func checkRecordFields(t *testing.T, st Storage) {
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	activeFrom, activeUntil := expiresAt.Add(-30*time.Minute), expiresAt.Add(-10*time.Minute)
+	clicks := int64(3)
+	want := models.URLRecord{
+		UUID:          "uuid",
+		ShortURL:      "full",
+		OriginalURL:   "https://full.ru",
+		UserID:        "user",
+		ExpiresAt:     &expiresAt,
+		ClicksLeft:    &clicks,
+		PasswordHash:  "$2a$10$hash",
+		RedirectType:  308,
+		Passthrough:   true,
+		UTMTemplate:   "spring",
+		DeviceRules:   []models.DeviceRule{{OS: "ios", URL: "https://apps.apple.com/app"}, {Device: "desktop", URL: "https://full.ru/web"}},
+		GeoRules:      []models.GeoRule{{Countries: []string{"DE", "AT"}, URL: "https://full.de"}},
+		Variants:      []models.Variant{{URL: "https://full.ru/a", Weight: 70}, {URL: "https://full.ru/b", Weight: 30}},
+		Sticky:        true,
+		Rotation:      []string{"https://mirror1.full.ru", "https://mirror2.full.ru"},
+		ActiveFrom:    &activeFrom,
+		ActiveUntil:   &activeUntil,
+		PrelaunchURL:  "https://full.ru/soon",
+		PostExpiryURL: "https://full.ru/over",
+		FallbackURL:   "https://mirror.full.ru",
+	}
+	require.NoError(t, st.Save(ctx, want))
+	got, err := st.Get(ctx, "full")
+	require.NoError(t, err)
+	require.NotNil(t, got.ExpiresAt)
+	require.True(t, expiresAt.Equal(*got.ExpiresAt))
+	require.NotNil(t, got.ActiveFrom)
+	require.True(t, activeFrom.Equal(*got.ActiveFrom))
+	require.NotNil(t, got.ActiveUntil)
+	require.True(t, activeUntil.Equal(*got.ActiveUntil))
+	got.ExpiresAt, got.ActiveFrom, got.ActiveUntil = want.ExpiresAt, want.ActiveFrom, want.ActiveUntil // time zones may differ
+	require.Equal(t, want, got)
+}
+
+func TestMemoryStorageRecordFields(t *testing.T) {
+	checkRecordFields(t, NewMemoryStorage(nil))
+}
+
+// checkUTMTemplates saves the templates of two users, the same for every backend
+func checkUTMTemplates(t *testing.T, st Storage) {
+	ctx := context.Background()
+	spring := models.UTMTemplate{Name: "spring", UserID: "u1", Source: "newsletter", Medium: "email", Campaign: "spring-sale"}
+	require.NoError(t, st.SaveUTMTemplate(ctx, spring))
+	require.NoError(t, st.SaveUTMTemplate(ctx, models.UTMTemplate{Name: "autumn", UserID: "u1", Source: "tg"}))
+	require.NoError(t, st.SaveUTMTemplate(ctx, models.UTMTemplate{Name: "spring", UserID: "u2", Source: "vk"}))
+	require.ErrorIs(t, st.SaveUTMTemplate(ctx, models.UTMTemplate{Name: "spring", UserID: "u1", Source: "x"}), ErrUTMTemplateExists)
+
+	got, err := st.GetUTMTemplate(ctx, "u1", "spring")
+	require.NoError(t, err)
+	require.Equal(t, spring, got)
+	_, err = st.GetUTMTemplate(ctx, "u3", "spring")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	list, err := st.ListUTMTemplates(ctx, "u1")
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	require.Equal(t, "autumn", list[0].Name)
+	require.Equal(t, "spring", list[1].Name)
+	list, err = st.ListUTMTemplates(ctx, "u3")
+	require.NoError(t, err)
+	require.Empty(t, list)
+}
+
+func TestMemoryStorageUTMTemplates(t *testing.T) {
+	checkUTMTemplates(t, NewMemoryStorage(nil))
+}
+
+// checkVariantClicks counts the redirects to the variants from many goroutines at once,
+// the same for every backend
+func checkVariantClicks(t *testing.T, st Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "ab", OriginalURL: "https://ab.ru",
+		Variants: []models.Variant{{URL: "https://ab.ru/a", Weight: 1}, {URL: "https://ab.ru/b", Weight: 1}}}))
+
+	const clickers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < clickers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, st.AddVariantClick(ctx, "ab", i%2))
+		}(i)
+	}
+	wg.Wait()
+	require.NoError(t, st.AddVariantClick(ctx, "ab", 1))
+
+	clicks, err := st.VariantClicks(ctx, "ab")
+	require.NoError(t, err)
+	require.Equal(t, map[int]int64{0: clickers / 2, 1: clickers/2 + 1}, clicks)
+	require.ErrorIs(t, st.AddVariantClick(ctx, "nope", 0), ErrNotFound)
+
+	// the counts go away with the link
+	require.NoError(t, st.Delete(ctx, "ab"))
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "ab", OriginalURL: "https://ab.ru"}))
+	clicks, err = st.VariantClicks(ctx, "ab")
+	require.NoError(t, err)
+	require.Empty(t, clicks)
+}
+
+func TestMemoryStorageVariantClicks(t *testing.T) {
+	checkVariantClicks(t, NewMemoryStorage(nil))
+}
+
+// checkReleaseOriginalURL gives the original URL of a record to a new one, the old record stays
+// with its owner. The same for every backend
+func checkReleaseOriginalURL(t *testing.T, st Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "old", OriginalURL: "https://gift.ru", UserID: "u1"}))
+	require.NoError(t, st.ReleaseOriginalURL(ctx, "old"))
+	require.ErrorIs(t, st.ReleaseOriginalURL(ctx, "old"), ErrNotFound)
+	require.ErrorIs(t, st.ReleaseOriginalURL(ctx, "nope"), ErrNotFound)
+
+	_, err := st.GetByOriginal(ctx, "https://gift.ru")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "new", OriginalURL: "https://gift.ru", UserID: "u2"}))
+	rec, err := st.GetByOriginal(ctx, "https://gift.ru")
+	require.NoError(t, err)
+	require.Equal(t, "new", rec.ShortURL)
+
+	rec, err = st.Get(ctx, "old")
+	require.NoError(t, err)
+	require.True(t, rec.Released)
+	require.False(t, rec.DeletedFlag)
+	list, err := st.ListByUser(ctx, "u1", "", 10)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+
+	// a new destination is held again
+	rec, err = st.UpdateOriginalURL(ctx, "u1", "old", "https://gift.ru/v2")
+	require.NoError(t, err)
+	require.False(t, rec.Released)
+	rec, err = st.GetByOriginal(ctx, "https://gift.ru/v2")
+	require.NoError(t, err)
+	require.Equal(t, "old", rec.ShortURL)
+}
+
+func TestMemoryStorageReleaseOriginalURL(t *testing.T) {
+	checkReleaseOriginalURL(t, NewMemoryStorage(nil))
+}
+
+// checkListWithFallback lists only the live records with a fallback URL. The same for every backend
+func checkListWithFallback(t *testing.T, st Storage) {
+	ctx := context.Background()
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	for _, rec := range []models.URLRecord{
+		{ShortURL: "live", OriginalURL: "https://live.ru", FallbackURL: "https://mirror.live.ru", UserID: "u1"},
+		{ShortURL: "later", OriginalURL: "https://later.ru", FallbackURL: "https://mirror.later.ru", ExpiresAt: &future},
+		{ShortURL: "expired", OriginalURL: "https://expired.ru", FallbackURL: "https://mirror.expired.ru", ExpiresAt: &past},
+		{ShortURL: "deleted", OriginalURL: "https://deleted.ru", FallbackURL: "https://mirror.deleted.ru", UserID: "u1"},
+		{ShortURL: "plain", OriginalURL: "https://plain.ru"},
+	} {
+		require.NoError(t, st.Save(ctx, rec))
+	}
+	require.NoError(t, st.DeleteUserURLs(ctx, "u1", []string{"deleted"}))
+
+	list, err := st.ListWithFallback(ctx, now)
+	require.NoError(t, err)
+	var got []string
+	for _, rec := range list {
+		require.NotEmpty(t, rec.FallbackURL)
+		got = append(got, rec.ShortURL)
+	}
+	require.ElementsMatch(t, []string{"live", "later"}, got)
+}
+
+func TestMemoryStorageListWithFallback(t *testing.T) {
+	checkListWithFallback(t, NewMemoryStorage(nil))
+}
+
+// checkNextRotation takes the rotation steps from many goroutines at once, none may be
+// skipped or repeated. The same for every backend
+func checkNextRotation(t *testing.T, st Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "mirrors", OriginalURL: "https://mirrors.ru",
+		Rotation: []string{"https://m1.mirrors.ru", "https://m2.mirrors.ru", "https://m3.mirrors.ru"}}))
+
+	const redirects = 50
+	steps := make([]int64, redirects)
+	var wg sync.WaitGroup
+	for i := 0; i < redirects; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n, err := st.NextRotation(ctx, "mirrors")
+			assert.NoError(t, err)
+			steps[i] = n
+		}(i)
+	}
+	wg.Wait()
+	slices.Sort(steps)
+	for i, n := range steps {
+		require.Equal(t, int64(i), n)
+	}
+	n, err := st.NextRotation(ctx, "mirrors")
+	require.NoError(t, err)
+	require.Equal(t, int64(redirects), n)
+	_, err = st.NextRotation(ctx, "nope")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// the cursor goes away with the link
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "gone", OriginalURL: "https://gone.ru", Rotation: []string{"https://gone.ru/1"}}))
+	_, err = st.NextRotation(ctx, "gone")
+	require.NoError(t, err)
+	require.NoError(t, st.Delete(ctx, "gone"))
+	require.NoError(t, st.Save(ctx, models.URLRecord{ShortURL: "gone", OriginalURL: "https://gone.ru", Rotation: []string{"https://gone.ru/1"}}))
+	n, err = st.NextRotation(ctx, "gone")
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestMemoryStorageNextRotation(t *testing.T) {
+	checkNextRotation(t, NewMemoryStorage(nil))
+}
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS urls (
+    uuid         TEXT PRIMARY KEY,
+    short_url    TEXT NOT NULL UNIQUE,
+    original_url TEXT NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS urls_original_url_idx ON urls (original_url);
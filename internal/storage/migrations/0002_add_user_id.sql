@@ -0,0 +1,3 @@
+ALTER TABLE urls ADD COLUMN user_id TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS urls_user_id_idx ON urls (user_id);
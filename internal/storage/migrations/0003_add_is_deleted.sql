@@ -0,0 +1,5 @@
+ALTER TABLE urls ADD COLUMN is_deleted BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- a deleted link doesn't hold its original URL any more
+DROP INDEX IF EXISTS urls_original_url_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS urls_original_url_idx ON urls (original_url) WHERE is_deleted = FALSE;
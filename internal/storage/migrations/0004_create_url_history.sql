@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS url_history (
+    short_url    TEXT      NOT NULL,
+    revision     INTEGER   NOT NULL,
+    original_url TEXT      NOT NULL,
+    changed_at   TIMESTAMP NOT NULL,
+    PRIMARY KEY (short_url, revision)
+);
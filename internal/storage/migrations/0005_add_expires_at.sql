@@ -0,0 +1,3 @@
+ALTER TABLE urls ADD COLUMN expires_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS urls_expires_at_idx ON urls (expires_at);
@@ -0,0 +1,2 @@
+-- 0 is the server default
+ALTER TABLE urls ADD COLUMN redirect_type INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE urls ADD COLUMN passthrough BOOLEAN NOT NULL DEFAULT FALSE;
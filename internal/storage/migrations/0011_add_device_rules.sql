@@ -0,0 +1,2 @@
+-- JSON array of the rules, empty for none
+ALTER TABLE urls ADD COLUMN device_rules TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,10 @@
+-- JSON array of the weighted destinations, empty for none
+ALTER TABLE urls ADD COLUMN variants TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN sticky BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS url_variant_clicks (
+    short_url TEXT    NOT NULL,
+    variant   INTEGER NOT NULL,
+    clicks    INTEGER NOT NULL,
+    PRIMARY KEY (short_url, variant)
+);
@@ -0,0 +1,4 @@
+ALTER TABLE urls ADD COLUMN active_from TIMESTAMP;
+ALTER TABLE urls ADD COLUMN active_until TIMESTAMP;
+ALTER TABLE urls ADD COLUMN prelaunch_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN post_expiry_url TEXT NOT NULL DEFAULT '';
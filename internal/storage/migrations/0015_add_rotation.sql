@@ -0,0 +1,4 @@
+-- JSON array of the destinations taken in turn, empty for none
+ALTER TABLE urls ADD COLUMN rotation TEXT NOT NULL DEFAULT '';
+-- redirects made by the rotation, the next destination is rotated % its length
+ALTER TABLE urls ADD COLUMN rotated BIGINT NOT NULL DEFAULT 0;
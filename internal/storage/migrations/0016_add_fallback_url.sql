@@ -0,0 +1 @@
+ALTER TABLE urls ADD COLUMN fallback_url TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS urls_fallback_url_idx ON urls (short_url) WHERE fallback_url <> '';
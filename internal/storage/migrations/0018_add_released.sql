@@ -0,0 +1,5 @@
+ALTER TABLE urls ADD COLUMN released BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- a released link has given its original URL to a newer one
+DROP INDEX IF EXISTS urls_original_url_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS urls_original_url_idx ON urls (original_url) WHERE is_deleted = FALSE AND released = FALSE;
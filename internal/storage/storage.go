@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/absurd678/skill/internal/models"
+)
+
+var (
+	// ErrNotFound is returned when there is no record for the short URL
+	ErrNotFound = errors.New("storage: short URL not found")
+	// ErrShortURLExists is returned by Save when the short URL is already taken
+	ErrShortURLExists = errors.New("storage: short URL already exists")
+	// ErrOriginalURLExists is returned by Save when the original URL is already shortened
+	ErrOriginalURLExists = errors.New("storage: original URL already exists")
+	// ErrUTMTemplateExists is returned by SaveUTMTemplate when the user already has the name
+	ErrUTMTemplateExists = errors.New("storage: UTM template already exists")
+	// ErrNoClicksLeft is returned by UseClick when a click-limited link is exhausted
+	ErrNoClicksLeft = errors.New("storage: no clicks left")
+)
+
+// Storage hides the place where the short -> original URL pairs are kept,
+// so the handlers don't depend on a particular backend
+type Storage interface {
+	// Save adds the record or returns ErrShortURLExists if its short URL is taken
+	// and ErrOriginalURLExists if its original URL is already shortened (and not deleted)
+	Save(ctx context.Context, rec models.URLRecord) error
+	// SaveBatch adds all the records or none of them (same errors as Save)
+	SaveBatch(ctx context.Context, recs []models.URLRecord) error
+	// Get returns the record by its short URL or ErrNotFound (deleted records too, with DeletedFlag)
+	Get(ctx context.Context, shortURL string) (models.URLRecord, error)
+	// UseClick takes one click of a click-limited record atomically and returns
+	// the record after it, or ErrNoClicksLeft. Unlimited records are returned as is.
+	UseClick(ctx context.Context, shortURL string) (models.URLRecord, error)
+	// GetByOriginal returns the not deleted and not released record by its original URL or ErrNotFound
+	GetByOriginal(ctx context.Context, originalURL string) (models.URLRecord, error)
+	// ReleaseOriginalURL lets a new record have the original URL of this one, which stays with its owner
+	// as it is. Returns ErrNotFound if the record is unknown, deleted or released already
+	ReleaseOriginalURL(ctx context.Context, shortURL string) error
+	// DeleteUserURLs marks the records of the user as deleted, the short URLs
+	// of other users and unknown ones are skipped
+	DeleteUserURLs(ctx context.Context, userID string, shortURLs []string) error
+	// UpdateOriginalURL changes the destination of the not deleted record of the user
+	// and keeps the previous one in the history, a released record holds the new URL again. Returns ErrNotFound if there is
+	// no such record and ErrOriginalURLExists if the new URL is already shortened.
+	UpdateOriginalURL(ctx context.Context, userID, shortURL, originalURL string) (models.URLRecord, error)
+	// History returns the previous destinations of the short URL, oldest first
+	History(ctx context.Context, shortURL string) ([]models.URLRevision, error)
+	// DeleteExpired removes the records expired by now and returns how many
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+	// Delete removes the record by its short URL or returns ErrNotFound
+	Delete(ctx context.Context, shortURL string) error
+	// List returns all the records in no particular order
+	List(ctx context.Context) ([]models.URLRecord, error)
+	// ListWithFallback returns the records with a fallback URL that are neither deleted nor expired by now
+	ListWithFallback(ctx context.Context, now time.Time) ([]models.URLRecord, error)
+	// ListByUser returns up to limit not deleted records of the user with short URLs
+	// greater than after, ordered by short URL (after is "" for the first page)
+	ListByUser(ctx context.Context, userID string, after string, limit int) ([]models.URLRecord, error)
+	// AddVariantClick counts a redirect to the variant (by index) of the record or returns ErrNotFound
+	AddVariantClick(ctx context.Context, shortURL string, variant int) error
+	// VariantClicks returns the redirects to the variants of the record by index, the ones never picked are missing
+	VariantClicks(ctx context.Context, shortURL string) (map[int]int64, error)
+	// NextRotation returns how many redirects the rotation of the record has made before
+	// and counts this one, atomically and durably for the backend, or returns ErrNotFound
+	NextRotation(ctx context.Context, shortURL string) (int64, error)
+	// SaveUTMTemplate adds the template of its user or returns ErrUTMTemplateExists
+	SaveUTMTemplate(ctx context.Context, tpl models.UTMTemplate) error
+	// GetUTMTemplate returns the template of the user by name or ErrNotFound
+	GetUTMTemplate(ctx context.Context, userID, name string) (models.UTMTemplate, error)
+	// ListUTMTemplates returns the templates of the user ordered by name
+	ListUTMTemplates(ctx context.Context, userID string) ([]models.UTMTemplate, error)
+	// Ping checks the backend is reachable
+	Ping(ctx context.Context) error
+	// Close releases the backend resources
+	Close() error
+}
@@ -0,0 +1,94 @@
+// Package useragent tells the OS and the kind of device from a User-Agent header.
+// Only the common families are known, the rest are reported as unknown ("").
+package useragent
+
+import (
+	"regexp"
+	"strings"
+)
+
+// OS families
+const (
+	IOS      = "ios"
+	Android  = "android"
+	Windows  = "windows"
+	MacOS    = "macos"
+	Linux    = "linux"
+	ChromeOS = "chromeos"
+)
+
+// Device kinds
+const (
+	Mobile  = "mobile"
+	Tablet  = "tablet"
+	Desktop = "desktop"
+	Bot     = "bot"
+)
+
+// OSes and Devices are the values Parse can return besides ""
+var (
+	OSes    = []string{IOS, Android, Windows, MacOS, Linux, ChromeOS}
+	Devices = []string{Mobile, Tablet, Desktop, Bot}
+)
+
+// Info is what is known about the client
+type Info struct {
+	OS     string
+	Device string
+}
+
+// bot markers, the crawlers that don't say "bot" are listed by name
+var botMarkers = []string{"crawler", "spider", "slurp", "facebookexternalhit", "curl/", "wget/"}
+
+// botToken is a product name ending in "bot" like Googlebot/2.1, Slackbot 1.0 or TelegramBot (like TwitterBot),
+// a bare "bot" inside a word or a model name (CUBOT X30) is not one
+var botToken = regexp.MustCompile(`bot(?:[/;)-]|$| [\d(])`)
+
+// Parse looks for the well known markers in the header. iPads asking for the desktop
+// site (the default since iPadOS 13) look like Macs and are reported as such
+func Parse(ua string) Info {
+	s := strings.ToLower(ua)
+	if s == "" {
+		return Info{}
+	}
+	info := Info{OS: parseOS(s)}
+	switch {
+	case botToken.MatchString(s) || containsAny(s, botMarkers...):
+		info.Device = Bot
+	case containsAny(s, "ipad", "tablet") || (info.OS == Android && !strings.Contains(s, "mobile")):
+		info.Device = Tablet
+	case containsAny(s, "mobi", "iphone", "ipod", "windows phone"):
+		info.Device = Mobile
+	default:
+		info.Device = Desktop
+	}
+	return info
+}
+
+// parseOS checks the more specific families first: iOS and Android say "like Mac OS X" and "Linux"
+func parseOS(s string) string {
+	switch {
+	case containsAny(s, "iphone", "ipad", "ipod"):
+		return IOS
+	case strings.Contains(s, "android"):
+		return Android
+	case containsAny(s, "; cros ", "(cros "): // a token of its own, "microsoft" has it too
+		return ChromeOS
+	case containsAny(s, "windows", "win64", "win32"):
+		return Windows
+	case containsAny(s, "macintosh", "mac os x"):
+		return MacOS
+	case strings.Contains(s, "linux"):
+		return Linux
+	}
+	return ""
+}
+
+func containsAny(s string, subs ...string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package useragent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		Name string
+		UA   string
+		Want Info
+	}{
+		{Name: "iPhone Safari", UA: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+			Want: Info{OS: IOS, Device: Mobile}},
+		{Name: "iPad", UA: "Mozilla/5.0 (iPad; CPU OS 12_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148",
+			Want: Info{OS: IOS, Device: Tablet}},
+		{Name: "Android phone", UA: "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36",
+			Want: Info{OS: Android, Device: Mobile}},
+		{Name: "Android tablet", UA: "Mozilla/5.0 (Linux; Android 13; SM-X200) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			Want: Info{OS: Android, Device: Tablet}},
+		{Name: "Windows Chrome", UA: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			Want: Info{OS: Windows, Device: Desktop}},
+		{Name: "Mac Firefox", UA: "Mozilla/5.0 (Macintosh; Intel Mac OS X 14.4; rv:125.0) Gecko/20100101 Firefox/125.0",
+			Want: Info{OS: MacOS, Device: Desktop}},
+		{Name: "Linux Firefox", UA: "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0",
+			Want: Info{OS: Linux, Device: Desktop}},
+		{Name: "Chromebook", UA: "Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			Want: Info{OS: ChromeOS, Device: Desktop}},
+		{Name: "Googlebot", UA: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			Want: Info{Device: Bot}},
+		{Name: "Googlebot smartphone", UA: "Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			Want: Info{OS: Android, Device: Bot}},
+		{Name: "Outlook", UA: "Microsoft Office/16.0 (Windows NT 10.0; Microsoft Outlook 16.0.17328; Pro)",
+			Want: Info{OS: Windows, Device: Desktop}},
+		{Name: "CUBOT phone", UA: "Mozilla/5.0 (Linux; Android 10; CUBOT X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36",
+			Want: Info{OS: Android, Device: Mobile}},
+		{Name: "Slackbot", UA: "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", Want: Info{Device: Bot}},
+		{Name: "Slackbot with a version", UA: "Slackbot 1.0 (+https://api.slack.com/robots)", Want: Info{Device: Bot}},
+		{Name: "Telegram", UA: "TelegramBot (like TwitterBot)", Want: Info{Device: Bot}},
+		{Name: "curl", UA: "curl/8.5.0", Want: Info{Device: Bot}},
+		{Name: "Unknown", UA: "SomethingElse/1.0", Want: Info{Device: Desktop}},
+		{Name: "Empty", UA: "", Want: Info{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require.Equal(t, tc.Want, Parse(tc.UA))
+		})
+	}
+}